@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/bits"
 	"os"
 	"os/signal"
 	"runtime"
@@ -12,10 +13,16 @@ import (
 	"unsafe"
 
 	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/eventcount"
+	"github.com/twmb/dash/queue"
 	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+	"github.com/twmb/dash/queue/mpmc/mpmcprio"
+	"github.com/twmb/dash/queue/mpmc/mpmcshard"
 	"github.com/twmb/dash/queue/mpsc/mpscdvq"
 	"github.com/twmb/dash/queue/spmc/spmcdvq"
 	"github.com/twmb/dash/queue/spsc/spscdvq"
+	"github.com/twmb/dash/queue/spsc/spsclamport"
+	"github.com/twmb/dash/wait"
 
 	"github.com/twmb/dash/bench/etime"
 	"github.com/twmb/dash/bench/qbench"
@@ -49,72 +56,52 @@ func (ch Chan) Dequeue() unsafe.Pointer {
 	return <-ch
 }
 
-// Define a DVQ interface so mpmc, spmc, mpsc, spsc can all use the same
-// Enqueue and Dequeue functions.
-
-type DVQ interface {
-	TryEnqueue(unsafe.Pointer) bool
-	TryDequeue() (unsafe.Pointer, bool)
+// BlockDVQ adds blocking around all dvq's with wait strategies, which are
+// blocks unless benchmarking another strategy. If One is set, each enqueue or
+// dequeue wakes one waiter with SignalOne, rather than all waiters with
+// Signal.
+type BlockDVQ struct {
+	Q    queue.TryQueue
+	EnqW wait.Strategy
+	DeqW wait.Strategy
+	One  bool
 }
 
-// BlockDVQ adds blocking around all dvq's.
-type BlockDVQ struct {
-	Q    DVQ
-	EnqB *block.Block
-	DeqB *block.Block
+func (q BlockDVQ) signal(w wait.Strategy) {
+	if q.One {
+		w.SignalOne()
+	} else {
+		w.Signal()
+	}
 }
 
 func (q BlockDVQ) Enqueue(enq unsafe.Pointer) {
-	for {
-		// Attempt faster non-block-using path.
-		enqueued := q.Q.TryEnqueue(enq)
-		if enqueued {
-			// We enqueued, signal the dequeue block.
-			q.DeqB.Signal()
-			break
-		}
-		// We were unable to dequeue; retry, but use our block
-		// if we fail again.
-		var primer uintptr
-		var primed bool
-		for !primed && !enqueued {
-			primer, primed = q.EnqB.Prime(primer)
-			enqueued = q.Q.TryEnqueue(enq)
-		}
-		if enqueued {
-			if primed {
-				q.EnqB.Cancel()
-			}
-			q.DeqB.Signal()
-			break
-		}
-		// Failed enqueueing after priming, wait to be awoken.
-		q.EnqB.Wait(primer)
-	}
+	q.EnqW.Do(func() bool { return q.Q.TryEnqueue(enq) })
+	q.signal(q.DeqW)
 }
 
 func (q BlockDVQ) Dequeue() unsafe.Pointer {
-	for {
-		deq, dequeued := q.Q.TryDequeue()
-		if dequeued {
-			q.EnqB.Signal()
-			return deq
-		}
-		var primer uintptr
-		var primed bool
-		for !primed && !dequeued {
-			primer, primed = q.DeqB.Prime(primer)
-			deq, dequeued = q.Q.TryDequeue()
-		}
-		if dequeued {
-			if primed {
-				q.DeqB.Cancel()
-			}
-			q.EnqB.Signal()
-			return deq
-		}
-		q.DeqB.Wait(primer)
-	}
+	var deq unsafe.Pointer
+	q.DeqW.Do(func() (dequeued bool) {
+		deq, dequeued = q.Q.TryDequeue()
+		return
+	})
+	q.signal(q.EnqW)
+	return deq
+}
+
+// Prio benchmarks a priority queue, prioritizing messages by their enqueue
+// time stamp so that the queue behaves as close to FIFO as it can.
+type Prio struct {
+	Q *mpmcprio.Queue
+}
+
+func (q Prio) Enqueue(enq unsafe.Pointer) {
+	q.Q.Insert(uint64(*(*int64)(enq)), enq)
+}
+
+func (q Prio) Dequeue() unsafe.Pointer {
+	return q.Q.DeleteMin()
 }
 
 /******************************************************************************
@@ -129,17 +116,81 @@ func benchChan(cfg qbench.Cfg) qbench.Results {
 func benchMpMcDVq(cfg qbench.Cfg) qbench.Results {
 	cfg.Impl = BlockDVQ{
 		Q:    mpmcdvq.New(queueSize),
-		EnqB: block.New(),
-		DeqB: block.New(),
+		EnqW: block.New(),
+		DeqW: block.New(),
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcDVqOne(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = BlockDVQ{
+		Q:    mpmcdvq.New(queueSize),
+		EnqW: block.New(),
+		DeqW: block.New(),
+		One:  true,
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcDVqWait(cfg qbench.Cfg, newWait func() wait.Strategy) qbench.Results {
+	cfg.Impl = BlockDVQ{
+		Q:    mpmcdvq.New(queueSize),
+		EnqW: newWait(),
+		DeqW: newWait(),
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcDVqEventCount(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = BlockDVQ{
+		Q:    mpmcdvq.New(queueSize),
+		EnqW: eventcount.New(),
+		DeqW: eventcount.New(),
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcDVqCompact(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = BlockDVQ{
+		Q:    mpmcdvq.NewCompact(queueSize),
+		EnqW: block.New(),
+		DeqW: block.New(),
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcShard(cfg qbench.Cfg) qbench.Results {
+	// Keep the total capacity the same as the other queues, spread across
+	// at most one shard per P. mpmcshard rounds the shard count and size
+	// up to powers of two, so we round the shard count down to a power of
+	// two, which evenly divides queueSize.
+	shards := uint(1) << (bits.Len(uint(runtime.GOMAXPROCS(0))) - 1)
+	if shards > queueSize {
+		shards = queueSize
+	}
+	cfg.Impl = BlockDVQ{
+		Q:    mpmcshard.New(shards, queueSize/shards),
+		EnqW: block.New(),
+		DeqW: block.New(),
 	}
 	return qbench.Bench(cfg)
 }
 
+func benchMpMcPrioStrict(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = Prio{mpmcprio.New(queueSize, mpmcprio.Strict)}
+	return qbench.Bench(cfg)
+}
+
+func benchMpMcPrioRelaxed(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = Prio{mpmcprio.New(queueSize, mpmcprio.Relaxed)}
+	return qbench.Bench(cfg)
+}
+
 func benchMpScDVq(cfg qbench.Cfg) qbench.Results {
 	cfg.Impl = BlockDVQ{
 		Q:    mpscdvq.New(queueSize),
-		EnqB: block.New(),
-		DeqB: block.New(),
+		EnqW: block.New(),
+		DeqW: block.New(),
 	}
 	return qbench.Bench(cfg)
 }
@@ -147,8 +198,8 @@ func benchMpScDVq(cfg qbench.Cfg) qbench.Results {
 func benchSpMcDVq(cfg qbench.Cfg) qbench.Results {
 	cfg.Impl = BlockDVQ{
 		Q:    spmcdvq.New(queueSize),
-		EnqB: block.New(),
-		DeqB: block.New(),
+		EnqW: block.New(),
+		DeqW: block.New(),
 	}
 	return qbench.Bench(cfg)
 }
@@ -156,8 +207,17 @@ func benchSpMcDVq(cfg qbench.Cfg) qbench.Results {
 func benchSpScDVq(cfg qbench.Cfg) qbench.Results {
 	cfg.Impl = BlockDVQ{
 		Q:    spscdvq.New(queueSize),
-		EnqB: block.New(),
-		DeqB: block.New(),
+		EnqW: block.New(),
+		DeqW: block.New(),
+	}
+	return qbench.Bench(cfg)
+}
+
+func benchSpScLamport(cfg qbench.Cfg) qbench.Results {
+	cfg.Impl = BlockDVQ{
+		Q:    spsclamport.New(queueSize),
+		EnqW: block.New(),
+		DeqW: block.New(),
 	}
 	return qbench.Bench(cfg)
 }
@@ -240,6 +300,17 @@ func processResults(typ string, results qbench.Results) {
  * Run qbench.                                                                *
  ******************************************************************************/
 
+// waits are the wait strategies, other than blocks, to benchmark mpmcdvq with.
+var waits = []struct {
+	name string
+	new  func() wait.Strategy
+}{
+	{"spin", func() wait.Strategy { return wait.Spin{} }},
+	{"yield", func() wait.Strategy { return wait.Yield{} }},
+	{"sleep", func() wait.Strategy { return wait.Sleep{Min: time.Microsecond, Max: time.Millisecond} }},
+	{"futex", func() wait.Strategy { return wait.NewFutex() }},
+}
+
 func bench(quit, dead chan struct{}) {
 	// Prime our virtual memory space.
 	benchChan(qbench.Cfg{
@@ -274,6 +345,36 @@ func bench(quit, dead chan struct{}) {
 				results = benchMpMcDVq(cfg)
 				processResults("mpmcdvq", results)
 				runtime.GC()
+				fmt.Println("mpmcdvq signal one... ")
+				results = benchMpMcDVqOne(cfg)
+				processResults("mpmcdvq1", results)
+				runtime.GC()
+				for _, w := range waits {
+					fmt.Printf("mpmcdvq %s... \n", w.name)
+					results = benchMpMcDVqWait(cfg, w.new)
+					processResults("mpmcdvq"+w.name, results)
+					runtime.GC()
+				}
+				fmt.Println("mpmcdvq eventcount... ")
+				results = benchMpMcDVqEventCount(cfg)
+				processResults("mpmcdvqec", results)
+				runtime.GC()
+				fmt.Println("mpmcdvq compact... ")
+				results = benchMpMcDVqCompact(cfg)
+				processResults("mpmcdvqc", results)
+				runtime.GC()
+				fmt.Println("mpmcshard... ")
+				results = benchMpMcShard(cfg)
+				processResults("mpmcshard", results)
+				runtime.GC()
+				fmt.Println("mpmcprio strict... ")
+				results = benchMpMcPrioStrict(cfg)
+				processResults("mpmcprios", results)
+				runtime.GC()
+				fmt.Println("mpmcprio relaxed... ")
+				results = benchMpMcPrioRelaxed(cfg)
+				processResults("mpmcprior", results)
+				runtime.GC()
 				if enqueuers == 1 {
 					fmt.Println("spmcdvq... ")
 					results = benchSpMcDVq(cfg)
@@ -291,6 +392,10 @@ func bench(quit, dead chan struct{}) {
 					results = benchSpScDVq(cfg)
 					processResults("spscdvq", results)
 					runtime.GC()
+					fmt.Println("spsclamport... ")
+					results = benchSpScLamport(cfg)
+					processResults("spsclamport", results)
+					runtime.GC()
 				}
 				fmt.Println("done.")
 			}
@@ -0,0 +1,342 @@
+// Package qstress stress tests queues for correctness.
+//
+// Where qbench times a fixed workload, qstress runs randomized rounds for a
+// given duration: every round creates a queue of a random size and passes a
+// random number of messages through a random number of producers and
+// consumers. Meanwhile, GOMAXPROCS is changed, the garbage collector is run,
+// and producers and consumers randomly pause. Every message is checked to be
+// dequeued exactly once and uncorrupted, and, for FIFO queues, in the order
+// its producer enqueued it relative to every other message from that
+// producer. If no message is dequeued for a while, qstress declares the round
+// hung and dumps all goroutine stacks.
+package qstress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/wait"
+)
+
+// ErrHung is wrapped by the error Stress returns when a round stops making
+// progress. The round's goroutines cannot be stopped, so after ErrHung, the
+// program should exit.
+var ErrHung = errors.New("no progress")
+
+// Interface is used to enqueue and dequeue in stress tests.
+type Interface interface {
+	Enqueue(unsafe.Pointer)
+	Dequeue() unsafe.Pointer
+}
+
+// Blocking adds blocking around a TryQueue using two wait strategies.
+type Blocking struct {
+	Q    queue.TryQueue
+	EnqW wait.Strategy
+	DeqW wait.Strategy
+}
+
+// NewBlocking returns q wrapped with new blocks.
+func NewBlocking(q queue.TryQueue) Blocking {
+	return Blocking{q, block.New(), block.New()}
+}
+
+// NewBlockingWait returns q wrapped with the given strategies, waiting on enq
+// while the queue is full and deq while it is empty.
+func NewBlockingWait(q queue.TryQueue, enq, deq wait.Strategy) Blocking {
+	return Blocking{q, enq, deq}
+}
+
+// Enqueue enqueues ptr, waiting on EnqW while the queue is full.
+func (q Blocking) Enqueue(ptr unsafe.Pointer) {
+	q.EnqW.Do(func() bool { return q.Q.TryEnqueue(ptr) })
+	q.DeqW.Signal()
+}
+
+// Dequeue dequeues a value, waiting on DeqW while the queue is empty.
+func (q Blocking) Dequeue() unsafe.Pointer {
+	var ptr unsafe.Pointer
+	q.DeqW.Do(func() (dequeued bool) {
+		ptr, dequeued = q.Q.TryDequeue()
+		return
+	})
+	q.EnqW.Signal()
+	return ptr
+}
+
+// Cfg is the configuration used to run a stress test.
+type Cfg struct {
+	// New returns a new, empty queue of at least the given size.
+	New func(size uint) Interface
+	// MinSize and MaxSize bound the size of the queue in each round.
+	// Small sizes exercise wraparound and full queues. Zero means 2 and
+	// 64.
+	MinSize, MaxSize uint
+	// Producers and Consumers are the maximum counts of producers and
+	// consumers in each round. Single-producer or single-consumer queues
+	// must use 1. Zero means 8.
+	Producers, Consumers int
+	// Messages is the maximum count of messages to send through each
+	// round. Zero means 100000.
+	Messages int
+	// Procs is the maximum GOMAXPROCS to switch between. Zero means the
+	// number of CPUs.
+	Procs int
+	// Relaxed skips checking that each producer's messages are dequeued
+	// in order, for queues that do not guarantee FIFO order.
+	Relaxed bool
+	// Duration is how long to run rounds for.
+	Duration time.Duration
+	// Stall is how long a round can go without dequeueing a message before
+	// it is reported as hung. Zero means ten seconds.
+	Stall time.Duration
+	// Seed seeds the random choices of every round.
+	Seed int64
+	// Log, if non-nil, receives a line describing each round.
+	Log io.Writer
+	// Dump receives the goroutine stacks of a hung round. Nil means
+	// os.Stderr.
+	Dump io.Writer
+}
+
+func (cfg *Cfg) defaults() {
+	if cfg.MinSize == 0 {
+		cfg.MinSize = 2
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 64
+	}
+	if cfg.MaxSize < cfg.MinSize {
+		cfg.MaxSize = cfg.MinSize
+	}
+	if cfg.Producers == 0 {
+		cfg.Producers = 8
+	}
+	if cfg.Consumers == 0 {
+		cfg.Consumers = 8
+	}
+	if cfg.Messages == 0 {
+		cfg.Messages = 100000
+	}
+	if cfg.Procs == 0 {
+		cfg.Procs = runtime.NumCPU()
+	}
+	if cfg.Stall == 0 {
+		cfg.Stall = 10 * time.Second
+	}
+	if cfg.Log == nil {
+		cfg.Log = io.Discard
+	}
+	if cfg.Dump == nil {
+		cfg.Dump = os.Stderr
+	}
+}
+
+// Results summarizes a stress test.
+type Results struct {
+	// Rounds is the number of rounds run.
+	Rounds int
+	// Messages is the number of messages verified.
+	Messages int
+}
+
+// round is the random configuration of one round.
+type round struct {
+	n         int
+	seed      int64
+	size      uint
+	producers int
+	consumers int
+	messages  int
+}
+
+func (r round) String() string {
+	return fmt.Sprintf("round %d (seed %d): size %d, %d producers, %d consumers, %d messages",
+		r.n, r.seed, r.size, r.producers, r.consumers, r.messages)
+}
+
+// message is what producers enqueue. check guards against the queue handing
+// out a pointer to something other than a message.
+type message struct {
+	producer int
+	seq      int
+	check    int
+}
+
+func checksum(producer, seq int) int {
+	return producer*0x5bd1e995 ^ seq ^ 0x2545f491
+}
+
+// pauser randomly pauses a producer or consumer.
+type pauser struct {
+	rng *rand.Rand
+}
+
+func (p pauser) maybe() {
+	switch p.rng.Intn(4096) {
+	case 0:
+		time.Sleep(time.Duration(p.rng.Intn(100)) * time.Microsecond)
+	case 1, 2, 3, 4:
+		runtime.Gosched()
+	}
+}
+
+// Stress runs randomized rounds against queues returned from cfg.New until
+// cfg.Duration elapses, returning an error describing the first round that
+// lost, duplicated, corrupted, or reordered a message, or that hung.
+func Stress(cfg Cfg) (Results, error) {
+	cfg.defaults()
+	procs := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(procs)
+
+	var res Results
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	for end := time.Now().Add(cfg.Duration); time.Now().Before(end); {
+		r := round{
+			n:         res.Rounds,
+			seed:      rng.Int63(),
+			size:      cfg.MinSize + uint(rng.Intn(int(cfg.MaxSize-cfg.MinSize)+1)),
+			producers: 1 + rng.Intn(cfg.Producers),
+			consumers: 1 + rng.Intn(cfg.Consumers),
+			messages:  1 + rng.Intn(cfg.Messages),
+		}
+		fmt.Fprintln(cfg.Log, r)
+		if err := runRound(&cfg, r); err != nil {
+			return res, fmt.Errorf("qstress: %v: %w", r, err)
+		}
+		res.Rounds++
+		res.Messages += r.messages
+	}
+	return res, nil
+}
+
+func runRound(cfg *Cfg, r round) error {
+	q := cfg.New(r.size)
+	rng := rand.New(rand.NewSource(r.seed))
+
+	// seen[p][seq] counts how often message seq from producer p was
+	// dequeued.
+	seen := make([][]uint32, r.producers)
+	var progress uint64
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	var wg sync.WaitGroup
+	div, rem := r.messages/r.producers, r.messages%r.producers
+	for p := 0; p < r.producers; p++ {
+		enqueues := div
+		if p < rem {
+			enqueues++
+		}
+		seen[p] = make([]uint32, enqueues)
+		wg.Add(1)
+		go func(p, enqueues int, pause pauser) {
+			defer wg.Done()
+			for seq := 0; seq < enqueues; seq++ {
+				pause.maybe()
+				q.Enqueue(unsafe.Pointer(&message{p, seq, checksum(p, seq)}))
+			}
+		}(p, enqueues, pauser{rand.New(rand.NewSource(rng.Int63()))})
+	}
+
+	div, rem = r.messages/r.consumers, r.messages%r.consumers
+	for c := 0; c < r.consumers; c++ {
+		dequeues := div
+		if c < rem {
+			dequeues++
+		}
+		wg.Add(1)
+		go func(c, dequeues int, pause pauser) {
+			defer wg.Done()
+			// last[p] is the last sequence number this consumer
+			// dequeued from producer p.
+			last := make([]int, r.producers)
+			for i := range last {
+				last[i] = -1
+			}
+			for i := 0; i < dequeues; i++ {
+				pause.maybe()
+				m := (*message)(q.Dequeue())
+				atomic.AddUint64(&progress, 1)
+				switch {
+				case m == nil:
+					fail(fmt.Errorf("consumer %d dequeued nil", c))
+					continue
+				case m.producer < 0 || m.producer >= r.producers ||
+					m.seq < 0 || m.seq >= len(seen[m.producer]) ||
+					m.check != checksum(m.producer, m.seq):
+					fail(fmt.Errorf("consumer %d dequeued corrupt message %+v", c, *m))
+					continue
+				}
+				if n := atomic.AddUint32(&seen[m.producer][m.seq], 1); n > 1 {
+					fail(fmt.Errorf("consumer %d dequeued message %d from producer %d %d times", c, m.seq, m.producer, n))
+				}
+				if !cfg.Relaxed && m.seq <= last[m.producer] {
+					fail(fmt.Errorf("consumer %d dequeued message %d from producer %d after message %d", c, m.seq, m.producer, last[m.producer]))
+				}
+				last[m.producer] = m.seq
+			}
+		}(c, dequeues, pauser{rand.New(rand.NewSource(rng.Int63()))})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// While the round runs, churn GOMAXPROCS and run the garbage
+	// collector, and watch for the round stalling.
+	chaos := time.NewTicker(time.Millisecond)
+	defer chaos.Stop()
+	stall := time.NewTicker(cfg.Stall)
+	defer stall.Stop()
+	var lastProgress uint64
+	for {
+		select {
+		case <-done:
+			if firstErr != nil {
+				return firstErr
+			}
+			for p := range seen {
+				for seq, n := range seen[p] {
+					if n == 0 {
+						return fmt.Errorf("message %d from producer %d was never dequeued", seq, p)
+					}
+				}
+			}
+			return nil
+		case <-chaos.C:
+			switch rng.Intn(8) {
+			case 0:
+				runtime.GC()
+			case 1, 2:
+				runtime.GOMAXPROCS(1 + rng.Intn(cfg.Procs))
+			}
+		case <-stall.C:
+			now := atomic.LoadUint64(&progress)
+			if now != lastProgress {
+				lastProgress = now
+				continue
+			}
+			err := fmt.Errorf("%w for %v after %d of %d messages", ErrHung, cfg.Stall, now, r.messages)
+			fmt.Fprintf(cfg.Dump, "%v, goroutines:\n", err)
+			pprof.Lookup("goroutine").WriteTo(cfg.Dump, 2)
+			return err
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/eventcount"
+	follyq "github.com/twmb/dash/experimental/queue/mpmc/folly"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+	"github.com/twmb/dash/queue/mpmc/mpmcprio"
+	"github.com/twmb/dash/queue/mpmc/mpmcshard"
+	"github.com/twmb/dash/queue/mpsc/mpscdvq"
+	"github.com/twmb/dash/queue/spmc/spmcdvq"
+	"github.com/twmb/dash/queue/spsc/spscdvq"
+	"github.com/twmb/dash/queue/spsc/spsclamport"
+	"github.com/twmb/dash/wait"
+
+	"github.com/twmb/dash/bench/qstress"
+)
+
+var (
+	queues    = flag.String("queues", "all", "comma separated queues to stress, or all")
+	duration  = flag.Duration("duration", time.Minute, "how long to stress each queue")
+	producers = flag.Int("producers", 8, "maximum producers per round for multi-producer queues")
+	consumers = flag.Int("consumers", 8, "maximum consumers per round for multi-consumer queues")
+	messages  = flag.Int("messages", 100000, "maximum messages per round")
+	maxSize   = flag.Uint("max-size", 64, "maximum queue size per round")
+	procs     = flag.Int("procs", runtime.NumCPU(), "maximum GOMAXPROCS to switch between")
+	stall     = flag.Duration("stall", 10*time.Second, "how long a round can go without progress before it is considered hung")
+	seed      = flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	verbose   = flag.Bool("v", false, "print every round")
+	waitFlag  = flag.String("wait", "block", "wait strategy for blocking queues: block, eventcount, spin, yield, sleep, or futex")
+)
+
+// waits are the wait strategies a blocking queue can use.
+var waits = map[string]func() wait.Strategy{
+	"block":      func() wait.Strategy { return block.New() },
+	"eventcount": func() wait.Strategy { return eventcount.New() },
+	"spin":       func() wait.Strategy { return wait.Spin{} },
+	"yield":      func() wait.Strategy { return wait.Yield{} },
+	"sleep":      func() wait.Strategy { return wait.Sleep{Min: time.Microsecond, Max: time.Millisecond} },
+	"futex":      func() wait.Strategy { return wait.NewFutex() },
+}
+
+// blocking wraps q with the wait strategy chosen by the wait flag.
+func blocking(q queue.TryQueue) qstress.Interface {
+	newWait := waits[*waitFlag]
+	return qstress.NewBlockingWait(q, newWait(), newWait())
+}
+
+// Chan is a queue for a simple built in channel.
+type Chan chan unsafe.Pointer
+
+func (ch Chan) Enqueue(enq unsafe.Pointer) {
+	ch <- enq
+}
+
+func (ch Chan) Dequeue() unsafe.Pointer {
+	return <-ch
+}
+
+// Prio stresses a priority queue, prioritizing messages by when they were
+// enqueued so that the queue behaves as close to FIFO as it can.
+type Prio struct {
+	Q    *mpmcprio.Queue
+	prio *uint64
+}
+
+func (q Prio) Enqueue(enq unsafe.Pointer) {
+	q.Q.Insert(atomic.AddUint64(q.prio, 1), enq)
+}
+
+func (q Prio) Dequeue() unsafe.Pointer {
+	return q.Q.DeleteMin()
+}
+
+// target is a queue to stress. Single-producer and single-consumer queues
+// limit their producers and consumers to one.
+type target struct {
+	new     func(size uint) qstress.Interface
+	sp, sc  bool
+	relaxed bool
+}
+
+var targets = map[string]target{
+	"channel": {new: func(size uint) qstress.Interface {
+		return Chan(make(chan unsafe.Pointer, size))
+	}},
+	"mpmcdvq": {new: func(size uint) qstress.Interface {
+		return blocking(mpmcdvq.New(size))
+	}},
+	"mpmcdvqc": {new: func(size uint) qstress.Interface {
+		return blocking(mpmcdvq.NewCompact(size))
+	}},
+	"mpmcshard": {relaxed: true, new: func(size uint) qstress.Interface {
+		return blocking(mpmcshard.New(4, size))
+	}},
+	"mpmcprios": {relaxed: true, new: func(size uint) qstress.Interface {
+		return Prio{mpmcprio.New(size, mpmcprio.Strict), new(uint64)}
+	}},
+	"mpmcprior": {relaxed: true, new: func(size uint) qstress.Interface {
+		return Prio{mpmcprio.New(size, mpmcprio.Relaxed), new(uint64)}
+	}},
+	"mpscdvq": {sc: true, new: func(size uint) qstress.Interface {
+		return blocking(mpscdvq.New(size))
+	}},
+	"spmcdvq": {sp: true, new: func(size uint) qstress.Interface {
+		return blocking(spmcdvq.New(size))
+	}},
+	"spscdvq": {sp: true, sc: true, new: func(size uint) qstress.Interface {
+		return blocking(spscdvq.New(size))
+	}},
+	"spsclamport": {sp: true, sc: true, new: func(size uint) qstress.Interface {
+		return blocking(spsclamport.New(size))
+	}},
+	"folly": {new: func(size uint) qstress.Interface {
+		return follyq.New(size)
+	}},
+}
+
+func main() {
+	flag.Parse()
+	if _, ok := waits[*waitFlag]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown wait strategy %q\n", *waitFlag)
+		os.Exit(2)
+	}
+
+	var names []string
+	if *queues == "all" {
+		for name := range targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		names = strings.Split(*queues, ",")
+	}
+
+	failed := false
+	for _, name := range names {
+		t, ok := targets[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown queue %q\n", name)
+			os.Exit(2)
+		}
+		cfg := qstress.Cfg{
+			New:       t.new,
+			MaxSize:   *maxSize,
+			Producers: *producers,
+			Consumers: *consumers,
+			Messages:  *messages,
+			Procs:     *procs,
+			Relaxed:   t.relaxed,
+			Duration:  *duration,
+			Stall:     *stall,
+			Seed:      *seed,
+		}
+		if t.sp {
+			cfg.Producers = 1
+		}
+		if t.sc {
+			cfg.Consumers = 1
+		}
+		if *verbose {
+			cfg.Log = os.Stdout
+		}
+
+		fmt.Printf("%s (seed %d)... ", name, *seed)
+		results, err := qstress.Stress(cfg)
+		if err != nil {
+			fmt.Printf("FAIL after %d rounds\n%v\n", results.Rounds, err)
+			failed = true
+			if errors.Is(err, qstress.ErrHung) {
+				// The hung goroutines cannot be stopped.
+				break
+			}
+			continue
+		}
+		fmt.Printf("ok, %d rounds, %d messages\n", results.Rounds, results.Messages)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -7,30 +7,36 @@
 //
 // The general flow for use of a block is
 //
-//         // goroutine 1
-//         for {
-//                 did := lf.Sub()
-//                 if did {
-//                         break
-//                 }
-//                 var primer uint32
-//                 var primed bool
-//                 for !primed && !did  {
-//                         primer, primed := block.Prime()
-//                         did = lf.Sub()
-//                 }
-//                 if did {
-//                         if primed {
-//                                 block.Cancel()
-//                         }
-//                         break
-//                 }
-//                 block.Wait(primer)
-//         }
+//	// goroutine 1
+//	block.Do(lf.Sub)
 //
-//         // goroutine 2
-//         lf.Pub()
-//         block.Signal()
+//	// goroutine 2
+//	lf.Pub()
+//	block.Signal()
+//
+// Do retries lf.Sub until it succeeds, blocking between attempts. It is
+// shorthand for the following loop, which Prime, Cancel, and Wait remain
+// exported for:
+//
+//	for {
+//		did := lf.Sub()
+//		if did {
+//			break
+//		}
+//		var primer uintptr
+//		var primed bool
+//		for !primed && !did {
+//			primer, primed = block.Prime(primer)
+//			did = lf.Sub()
+//		}
+//		if did {
+//			if primed {
+//				block.Cancel()
+//			}
+//			break
+//		}
+//		block.Wait(primer)
+//	}
 //
 // Block has many internal checks to abort transitioning to a blocking state.
 // Block assumes that transitioning to a blocking state is worse than spinning,
@@ -43,15 +49,39 @@
 // when high throughput is desired at the expense of CPU. Blocks should only be
 // used in cases where the alternative is to spin or where you want something
 // faster than a mutex/condition variable combo.
+//
+// Signal wakes every waiter. When each signal is for a single item of work,
+// SignalOne (or SignalN, for n items) wakes only as many waiters as there is
+// work, rather than having every waiter wake to fight over it.
+//
+// Waiters that must honour deadlines or shutdown can use DoContext, or
+// WaitTimeout or WaitContext in place of Wait. These give up waiting once
+// their time is up without disturbing other waiters, at the cost of a channel
+// allocation and a short mutex hold per wait.
+//
+// Goroutines that need to wait on a Block and on other channels at once can
+// select on Chan in place of calling Wait:
+//
+//	select {
+//	case <-block.Chan(primer):
+//	case <-ctx.Done():
+//	}
+//	block.Cancel()
+//
+// To see whether a Block actually parks goroutines or only spins, create it
+// with NewStats and inspect its Stats. Recording stats costs a few atomic
+// adds per operation and a clock read around every park.
 package block
 
 import (
-	"math"
-	"runtime"
+	"context"
+	"math/bits"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/rwlock"
 )
 
 // Block provides a mechanism to wait around code that may spin.
@@ -61,146 +91,280 @@ type Block struct {
 	_pad1   [primitive.FalseShare - 4]byte
 	counter uintptr
 	_pad2   [primitive.FalseShare - primitive.UpSz]byte
-	lock    lock
+	wakes   int32
+	all     int32
+	_pad3   [primitive.FalseShare - 8]byte
+	lock    rwlock.Lock
 	cond    *sync.Cond
-	_pad3   [primitive.FalseShare - primitive.UpSz]byte
+	stats   *Stats
+	_pad4   [primitive.FalseShare - 2*primitive.UpSz]byte
+
+	// chMu guards ch, the channel Chan hands out, which the next signal
+	// closes. hasCh is set while ch is non-nil, so that signals only take
+	// chMu if somebody may be selecting on ch.
+	hasCh uint32
+	chMu  sync.Mutex
+	ch    chan struct{}
+
+	// tmu guards timed, the channels of waiters in WaitTimeout and
+	// WaitContext, longest waiting first. ntimed is len(timed), so that
+	// signals only take tmu if somebody may be waiting.
+	ntimed uint32
+	tmu    sync.Mutex
+	timed  []chan struct{}
 }
 
+// closedChan is returned from Chan when the block has already been signaled.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
 // New returns a new Block.
 func New() *Block {
 	b := new(Block)
-	b.cond = sync.NewCond(&b.lock)
+	b.cond = sync.NewCond(condLocker{&b.lock})
 	return b
 }
 
-// lock implements a spinning reader/writer lock with try lock semantics.
-type lock struct {
-	write uint32
-	_pad  [primitive.FalseShare - 4]byte
-	read  uint32
+// NewStats returns a new Block that records Stats. Stats are recorded with
+// sync/atomic rather than primitive, so that recording them does not add
+// steps to schedule explorations.
+func NewStats() *Block {
+	b := New()
+	b.stats = new(Stats)
+	return b
 }
 
-const highBit uint32 = 1 << 31
+// ParkedBuckets is the number of buckets in the Stats.Parked histogram.
+const ParkedBuckets = 24
 
-// TryLock sets the lock in a write state. This function allows one pending
-// write lock; additional pending write locks return failure.
-func (l *lock) TryLock() bool {
-	var write uint32
-	for {
-		// Add our lock desire, checking the state in the process.
-		write = atomic.AddUint32(&l.write, 1)
-		if write&highBit == 0 {
-			break
-		}
-		// If the high bit is set, the lock is being unlocked. We retry
-		// as we may now either be the first lock or the pending lock.
-		runtime.Gosched()
-	}
-
-	switch write {
-	case 1:
-		// We were the first to grab this lock - signal readers to exit
-		// and wait for them.
-		read := atomic.AddUint32(&l.read, highBit)
-		for read != highBit {
-			runtime.Gosched()
-			read = atomic.LoadUint32(&l.read)
-		}
-		return true
-	case 2:
-		// We were the second to grab this lock - we wait for the high
-		// bit to be set when unlocking. The unlocker will see multiple
-		// lock grabs and not reset the lock fully.
-		for write&highBit == 0 {
-			runtime.Gosched()
-			write = atomic.LoadUint32(&l.write)
-		}
-		// We have seen the high bit - set the lock back to the locked
-		// state.
-		atomic.StoreUint32(&l.write, 1)
-		return true
-	}
-	// We are not the first locker, nor the pending locker, and we did not
-	// see a lock unlocking. We can return.
-	return false
+// Stats contains counts of what a Block's waiters and signalers did.
+type Stats struct {
+	// Primes is the number of Prime calls.
+	Primes uint64
+	// Primed is the number of Prime calls that primed the block.
+	Primed uint64
+	// Waits is the number of Wait, WaitTimeout, and WaitContext calls.
+	Waits uint64
+	// EarlyReturns is the number of waits that returned because the block
+	// was signaled before they parked.
+	EarlyReturns uint64
+	// Parks is the number of times a waiter parked. One wait can park
+	// more than once if it is woken without being signaled, such as by a
+	// SignalN for other waiters.
+	Parks uint64
+	// Signals is the number of Signal, SignalOne, and SignalN calls that
+	// found waiters.
+	Signals uint64
+	// Coalesced is the number of those signals that collapsed into a
+	// pending signal rather than signaling themselves.
+	Coalesced uint64
+	// Parked is a histogram of how long waiters stayed parked. Parked[0]
+	// counts parks under a microsecond, Parked[i] parks from 2^(i-1) up to
+	// 2^i microseconds, and the last bucket every longer park.
+	Parked [ParkedBuckets]uint64
 }
 
-// WUnlock relinquishes our write lock.
-func (l *lock) WUnlock() {
-	// If more writers attempted our lock, write&^highBit will be >1, and
-	// the try that got 2 will be waiting in pending state. That waiter
-	// will now see we have unlocked, so we can leave.
-	write := atomic.AddUint32(&l.write, highBit)
-	if write&^highBit > 1 {
-		return
+// Stats returns a snapshot of the block's stats. Blocks not created with
+// NewStats return zero Stats.
+func (b *Block) Stats() Stats {
+	var s Stats
+	if b.stats == nil {
+		return s
+	}
+	s.Primes = atomic.LoadUint64(&b.stats.Primes)
+	s.Primed = atomic.LoadUint64(&b.stats.Primed)
+	s.Waits = atomic.LoadUint64(&b.stats.Waits)
+	s.EarlyReturns = atomic.LoadUint64(&b.stats.EarlyReturns)
+	s.Parks = atomic.LoadUint64(&b.stats.Parks)
+	s.Signals = atomic.LoadUint64(&b.stats.Signals)
+	s.Coalesced = atomic.LoadUint64(&b.stats.Coalesced)
+	for i := range s.Parked {
+		s.Parked[i] = atomic.LoadUint64(&b.stats.Parked[i])
 	}
-	// If nobody else attempted the lock by the time added the high bit,
-	// we must let readers continue (first) and then reset our write lock.
-	atomic.StoreUint32(&l.read, 0)
-	atomic.StoreUint32(&l.write, 0)
+	return s
 }
 
-// Lock, a noop, is provided to implement the sync.Locker interface for a
-// sync.Cond. In reality, after being woken from a Wait, we call TryRLock
-// ourselves.
-func (l *lock) Lock() {
+// condLocker adapts our lock for our cond. Waiters hold a read lock when
+// calling cond.Wait, which releases it; after waking, waiters re-take the
+// lock themselves with TryRLock, so locking is a no-op.
+type condLocker struct {
+	l *rwlock.Lock
 }
 
-// TryRLock attempts to grab a reader lock, failing if a writer has locked.
-func (l *lock) TryRLock() bool {
-	var swapped bool
-	read := atomic.LoadUint32(&l.read)
+func (c condLocker) Lock() {}
+
+func (c condLocker) Unlock() {
+	c.l.RUnlock()
+}
+
+// Do calls try until it returns true, waiting on the block between attempts
+// that fail.
+//
+// Do does not retain try, so closures passed to Do do not need to allocate.
+func (b *Block) Do(try func() bool) {
 	for {
-		if read&highBit != 0 { // writer has grabbed lock
-			return false
+		did := try()
+		if did {
+			return
 		}
-		read, swapped = primitive.CompareAndSwapUint32(&l.read, read, read+1)
-		if swapped { // we got a read lock
-			return true
+		var primer uintptr
+		var primed bool
+		for !primed && !did {
+			primer, primed = b.Prime(primer)
+			did = try()
 		}
+		if did {
+			if primed {
+				b.Cancel()
+			}
+			return
+		}
+		b.Wait(primer)
 	}
 }
 
-// Unlock decrements the lock by one reader. This is the counterpart to
-// TryRLock (if it succeeds), but named "Unlock" to satisfy the sync.Locker
-// interface.
-func (l *lock) Unlock() {
-	atomic.AddUint32(&l.read, math.MaxUint32) // wrap to decrement by one
+// DoContext is Do, giving up when ctx is done. It returns ctx.Err() if ctx
+// was done before try returned true.
+func (b *Block) DoContext(ctx context.Context, try func() bool) error {
+	for {
+		did := try()
+		if did {
+			return nil
+		}
+		var primer uintptr
+		var primed bool
+		for !primed && !did {
+			primer, primed = b.Prime(primer)
+			did = try()
+		}
+		if did {
+			if primed {
+				b.Cancel()
+			}
+			return nil
+		}
+		if err := b.WaitContext(ctx, primer); err != nil {
+			return err
+		}
+	}
 }
 
 // Prime, called before a function that may fail, returns what you will call
 // Wait with. If you do not call wait, and this call successfully primes the
 // block, you must call Cancel.
 func (b *Block) Prime(last uintptr) (primer uintptr, primed bool) {
-	primer = atomic.LoadUintptr(&b.counter)
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Primes, 1)
+	}
+	primer = primitive.LoadUintptr(&b.counter)
 	if primer != last {
 		return
 	}
-	runtime.Gosched()
-	primer = atomic.LoadUintptr(&b.counter)
-	if primer != last || atomic.LoadUint32(&b.lock.write) != 0 {
+	primitive.Gosched()
+	primer = primitive.LoadUintptr(&b.counter)
+	if primer != last || b.lock.Writing() {
 		return
 	}
 	primed = true
-	atomic.AddInt32(&b.waiters, 1)
+	primitive.AddInt32(&b.waiters, 1)
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Primed, 1)
+	}
 	return
 }
 
 // Cancel, which must be called if not calling Wait after a Prime, cancels one
 // primed block call.
 func (b *Block) Cancel() {
-	atomic.AddInt32(&b.waiters, -1)
+	primitive.AddInt32(&b.waiters, -1)
 }
 
 // Wait blocks until the block has been signaled to continue. This may
 // spuriously return early. The assumption is that re-checking an operation
 // that may fail is cheaper than blocking.
 func (b *Block) Wait(primer uintptr) {
+	b.wait(primer)
+}
+
+// WaitTimeout is Wait, giving up after d. It returns false if d elapsed before
+// the block was signaled. Like Wait, this may spuriously return true early.
+func (b *Block) WaitTimeout(primer uintptr, d time.Duration) bool {
+	expired := make(chan struct{})
+	t := time.AfterFunc(d, func() { close(expired) })
+	defer t.Stop()
+	return b.waitTimed(primer, expired)
+}
+
+// WaitContext is Wait, giving up when ctx is done. It returns ctx.Err() if ctx
+// was done before the block was signaled. Like Wait, this may spuriously
+// return nil early.
+func (b *Block) WaitContext(ctx context.Context, primer uintptr) error {
+	if ctx.Done() == nil {
+		b.wait(primer)
+		return nil
+	}
+	if !b.waitTimed(primer, ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Chan returns a channel that is closed once the block is signaled after the
+// Prime that returned primer, for callers that need to select on the block
+// alongside other channels. As with Wait, the channel may be closed
+// spuriously early, and it is already closed if the block has been signaled
+// since the Prime. After the channel is closed, or the caller stops selecting
+// on it, the caller must call Cancel.
+//
+// Every signal, including SignalOne and SignalN, closes the channel, waking
+// every goroutine selecting on it.
+func (b *Block) Chan(primer uintptr) <-chan struct{} {
+	b.chMu.Lock()
+	if b.ch == nil {
+		b.ch = make(chan struct{})
+		primitive.StoreUint32(&b.hasCh, 1)
+	}
+	c := b.ch
+	b.chMu.Unlock()
+	// We set hasCh before re-checking the counter, and signals increment
+	// the counter before checking hasCh: either we see the signal here,
+	// or the signal sees our channel and closes it.
+	if primer != primitive.LoadUintptr(&b.counter) {
+		return closedChan
+	}
+	return c
+}
+
+// closeChan closes the channel handed out by Chan, if any.
+func (b *Block) closeChan() {
+	if primitive.LoadUint32(&b.hasCh) == 0 {
+		return
+	}
+	b.chMu.Lock()
+	c := b.ch
+	b.ch = nil
+	primitive.StoreUint32(&b.hasCh, 0)
+	b.chMu.Unlock()
+	if c != nil {
+		close(c)
+	}
+}
+
+// wait implements Wait.
+func (b *Block) wait(primer uintptr) {
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Waits, 1)
+	}
+	parked := false
 	for {
 		for {
-			runtime.Gosched()
-			if primer != atomic.LoadUintptr(&b.counter) {
-				atomic.AddInt32(&b.waiters, -1)
+			primitive.Gosched()
+			if primer != primitive.LoadUintptr(&b.counter) {
+				primitive.AddInt32(&b.waiters, -1)
+				b.signaled(parked)
 				return
 
 			}
@@ -209,21 +373,139 @@ func (b *Block) Wait(primer uintptr) {
 			}
 		}
 		if primer != b.counter {
-			atomic.AddInt32(&b.waiters, -1)
-			b.lock.Unlock()
+			primitive.AddInt32(&b.waiters, -1)
+			b.lock.RUnlock()
+			b.signaled(parked)
 			return
 		}
-		b.cond.Wait()
+		b.park()
+		parked = true
 		// Waking up does not grab any lock.
 	}
 }
 
+// waitTimed implements WaitTimeout and WaitContext, returning false once
+// expired is closed. Only a broadcast could reach a waiter in the cond that
+// gives up, so timed waiters instead wait on their own channel, which signals
+// close in place of waking them from the cond. Giving up then only needs us
+// to take our channel back.
+func (b *Block) waitTimed(primer uintptr, expired <-chan struct{}) bool {
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Waits, 1)
+	}
+	ch := make(chan struct{})
+	b.tmu.Lock()
+	b.timed = append(b.timed, ch)
+	primitive.StoreUint32(&b.ntimed, uint32(len(b.timed)))
+	b.tmu.Unlock()
+
+	// We publish our channel before re-checking the counter, and signals
+	// increment the counter before checking ntimed: either we see the
+	// signal here, or the signal sees our channel.
+	parked := false
+	if primer == primitive.LoadUintptr(&b.counter) {
+		b.parkTimed(ch, expired)
+		parked = true
+	}
+	b.untime(ch)
+	primitive.AddInt32(&b.waiters, -1)
+	// A signal that closed our channel incremented the counter first, so
+	// we return true even if we expired at the same time, taking the
+	// wake it gave us.
+	if primer != primitive.LoadUintptr(&b.counter) {
+		b.signaled(parked)
+		return true
+	}
+	return false
+}
+
+// untime removes ch from the timed waiters, if a signal has not already.
+func (b *Block) untime(ch chan struct{}) {
+	b.tmu.Lock()
+	for i, c := range b.timed {
+		if c == ch {
+			b.timed = append(b.timed[:i], b.timed[i+1:]...)
+			primitive.StoreUint32(&b.ntimed, uint32(len(b.timed)))
+			break
+		}
+	}
+	b.tmu.Unlock()
+}
+
+// wakeTimed closes the channels of up to n of the longest waiting timed
+// waiters, or of every timed waiter if all is set, returning how many it
+// woke.
+func (b *Block) wakeTimed(n int32, all bool) int32 {
+	if primitive.LoadUint32(&b.ntimed) == 0 {
+		return 0
+	}
+	b.tmu.Lock()
+	if all || int(n) > len(b.timed) {
+		n = int32(len(b.timed))
+	}
+	for _, ch := range b.timed[:n] {
+		close(ch)
+	}
+	b.timed = append(b.timed[:0], b.timed[n:]...)
+	primitive.StoreUint32(&b.ntimed, uint32(len(b.timed)))
+	b.tmu.Unlock()
+	return n
+}
+
+// signaled records a wait returning because the block was signaled.
+func (b *Block) signaled(parked bool) {
+	if b.stats != nil && !parked {
+		atomic.AddUint64(&b.stats.EarlyReturns, 1)
+	}
+}
+
+// park waits on our cond, recording how long for.
+func (b *Block) park() {
+	if b.stats == nil {
+		b.cond.Wait()
+		return
+	}
+	atomic.AddUint64(&b.stats.Parks, 1)
+	start := time.Now()
+	b.cond.Wait()
+	b.parked(time.Since(start))
+}
+
+// parkTimed waits for a timed waiter's channel to be closed or for its wait
+// to expire, recording how long for.
+func (b *Block) parkTimed(ch, expired <-chan struct{}) {
+	var start time.Time
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Parks, 1)
+		start = time.Now()
+	}
+	select {
+	case <-ch:
+	case <-expired:
+	}
+	if b.stats != nil {
+		b.parked(time.Since(start))
+	}
+}
+
+// parked records a park lasting d in the Parked histogram.
+func (b *Block) parked(d time.Duration) {
+	bucket := bits.Len64(uint64(d / time.Microsecond))
+	if bucket >= ParkedBuckets {
+		bucket = ParkedBuckets - 1
+	}
+	atomic.AddUint64(&b.stats.Parked[bucket], 1)
+}
+
 // Signal, to be called after every operation that can un-wait a block, awakens
 // all block waiters.
 func (b *Block) Signal() {
-	if atomic.LoadInt32(&b.waiters) == 0 {
+	if primitive.LoadInt32(&b.waiters) == 0 {
 		return
 	}
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Signals, 1)
+	}
 	// We either get the lock, wait in pending state until we get the lock,
 	// or return because somebody else is in a pending state.
 	//
@@ -251,10 +533,75 @@ func (b *Block) Signal() {
 	// pending signal is the _same_ as having all signals race finishing
 	// immediately before any future Prime call, which would be the worst
 	// case scenario from a signaling perspective.
+	//
+	// We record that we want every waiter woken before trying the lock,
+	// so that if we collapse into a pending SignalN, it broadcasts for us.
+	primitive.StoreInt32(&b.all, 1)
 	if !b.lock.TryLock() {
+		b.coalesced()
 		return
 	}
-	atomic.AddUintptr(&b.counter, 1)
+	b.signal()
+}
+
+// signal, called with the write lock held, increments the counter, unlocks,
+// and wakes the waiters that we and every signal collapsed into us asked for:
+// everybody if any was a Signal, otherwise the sum of the SignalNs.
+func (b *Block) signal() {
+	primitive.AddUintptr(&b.counter, 1)
+	all := primitive.SwapInt32(&b.all, 0)
+	wakes := primitive.SwapInt32(&b.wakes, 0)
 	b.lock.WUnlock()
-	b.cond.Broadcast()
+	b.closeChan()
+	if all != 0 {
+		b.wakeTimed(0, true)
+		b.cond.Broadcast()
+		return
+	}
+	// We cannot tell how many waiters are in the cond, so we wake timed
+	// waiters first, and the cond for whatever of our wakes is left.
+	// sync.Cond wakes the longest sleeping waiters first. Those primed
+	// before our counter increment, and will return.
+	wakes -= b.wakeTimed(wakes, false)
+	for ; wakes > 0; wakes-- {
+		b.cond.Signal()
+	}
+}
+
+// coalesced records a signal collapsing into a pending signal.
+func (b *Block) coalesced() {
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Coalesced, 1)
+	}
+}
+
+// SignalOne is SignalN(1).
+func (b *Block) SignalOne() {
+	b.SignalN(1)
+}
+
+// SignalN, to be called after an operation that makes n items of work
+// available, awakens up to n block waiters. Waiters that have not yet gone to
+// sleep, as in Signal, all return; only sleeping waiters beyond the first n
+// stay asleep.
+func (b *Block) SignalN(n int) {
+	waiters := primitive.LoadInt32(&b.waiters)
+	if waiters == 0 || n <= 0 {
+		return
+	}
+	if b.stats != nil {
+		atomic.AddUint64(&b.stats.Signals, 1)
+	}
+	if int64(n) > int64(waiters) {
+		n = int(waiters)
+	}
+	// b.wakes counts waiters to wake across signals. We add ours before
+	// trying the lock: if we do not get the lock, the pending signal has
+	// yet to take it, and will wake our waiters along with its own.
+	primitive.AddInt32(&b.wakes, int32(n))
+	if !b.lock.TryLock() {
+		b.coalesced()
+		return
+	}
+	b.signal()
 }
@@ -1,7 +1,7 @@
 package block
 
 import (
-	"fmt"
+	"context"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -9,198 +9,342 @@ import (
 	"time"
 )
 
-// These benchmarks demonstrate simple throughput differences of my lock vs.
-// sync.RWMutex, where my lock is marginally different, and then very contended
-// differences, where my lock fast track wlock returns.  In "very contended"
-// (i.e., anything with no number), benchmarks, we start 10 goroutines per proc.
-//
-// As it turns out, my lock is worst for almost any standard usage of a lock.
-// The main benefit comes from readers being _unable_ to get the lock if one
-// writer is in a pending state. Readers have no chance to exclude writers
-// during the pending transition. This is beneficial for a block.
-//
-// I have tried separating out the writer bits into a separate mutex. It is
-// much slower in _use_, even though benchmarks show better numbers for
-// directly grabbing the lock.
-
-func TestLock(t *testing.T) {
-	var l lock
-	locked := l.TryLock()
-	if !locked {
-		t.Error("expected locked after TryLock")
-	}
-	go l.TryLock()
-	time.Sleep(time.Millisecond)
-	if atomic.LoadUint32(&l.write) != 2 {
-		t.Errorf("expected pendingWait after second TryLock")
+func TestWaitTimeout(t *testing.T) {
+	b := New()
+	primer, primed := b.Prime(0)
+	if !primed {
+		t.Fatal("unable to prime new block")
 	}
-	if l.TryLock() {
-		t.Error("unexpected TryLock get on doubly locked lock")
+	if b.WaitTimeout(primer, 10*time.Millisecond) {
+		t.Error("unexpected signal before timeout")
 	}
-	l.WUnlock()
-	time.Sleep(time.Millisecond)
-	if atomic.LoadUint32(&l.write) != 1 {
-		t.Error("expected locked after unlock from pendingWait")
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after timeout, expected 0", waiters)
 	}
 
+	primer, primed = b.Prime(0)
+	if !primed {
+		t.Fatal("unable to prime block after timeout")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Signal()
+	}()
+	if !b.WaitTimeout(primer, time.Minute) {
+		t.Error("timed out despite signal")
+	}
 }
 
-// wlock/wunlock
+func TestWaitContext(t *testing.T) {
+	b := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	primer, _ := b.Prime(0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := b.WaitContext(ctx, primer); err != context.Canceled {
+		t.Errorf("got %v after cancel, expected %v", err, context.Canceled)
+	}
 
-func BenchmarkLockW1(b *testing.B) {
-	var l lock
-	for i := 0; i < b.N; i++ {
-		if !l.TryLock() {
-			b.Fatal("unable to lock")
-		}
-		l.WUnlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	primer, _ = b.Prime(0)
+	if err := b.WaitContext(ctx, primer); err != context.DeadlineExceeded {
+		t.Errorf("got %v after deadline, expected %v", err, context.DeadlineExceeded)
+	}
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after expiry, expected 0", waiters)
 	}
 }
 
-func BenchmarkRWMutexW1(b *testing.B) {
-	var mtx sync.RWMutex
-	for i := 0; i < b.N; i++ {
-		mtx.Lock()
-		mtx.Unlock()
+// TestWaitExpiryLeavesOthers checks that an expiring waiter does not take
+// other waiters with it, and that those waiters still wake on Signal.
+func TestWaitExpiryLeavesOthers(t *testing.T) {
+	b := New()
+	primer, _ := b.Prime(0)
+	woke := make(chan bool)
+	go func() {
+		woke <- b.WaitTimeout(primer, time.Minute)
+	}()
+	primer2, _ := b.Prime(0)
+	if b.WaitTimeout(primer2, 10*time.Millisecond) {
+		t.Error("unexpected signal before timeout")
+	}
+	select {
+	case <-woke:
+		t.Fatal("other waiter returned on expiry")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.Signal()
+	if !<-woke {
+		t.Error("other waiter timed out despite signal")
 	}
 }
 
-// rlock/runlock
-
-func BenchmarkLockR1(b *testing.B) {
-	var l lock
-	for i := 0; i < b.N; i++ {
-		if !l.TryRLock() {
-			b.Fatal("unable to lock")
-		}
-		l.Unlock()
+// TestSignalNTimed checks that SignalN counts timed waiters among the
+// waiters it wakes, and that expired waiters do not take wakes from others.
+func TestSignalNTimed(t *testing.T) {
+	b := New()
+	woke := make(chan struct{}, 4)
+	for i := 0; i < 2; i++ {
+		primer, _ := b.Prime(0)
+		go func() {
+			b.Wait(primer)
+			woke <- struct{}{}
+		}()
+		timedPrimer, _ := b.Prime(0)
+		go func() {
+			if b.WaitTimeout(timedPrimer, time.Minute) {
+				woke <- struct{}{}
+			}
+		}()
+	}
+	primer, _ := b.Prime(0)
+	if b.WaitTimeout(primer, 20*time.Millisecond) {
+		t.Error("unexpected signal before timeout")
 	}
-}
 
-func BenchmarkRWMutexR1(b *testing.B) {
-	var mtx sync.RWMutex
-	for i := 0; i < b.N; i++ {
-		mtx.RLock()
-		mtx.RUnlock()
+	b.SignalOne()
+	if n := countWoke(woke); n != 1 {
+		t.Errorf("SignalOne woke %d waiters, expected 1", n)
+	}
+	b.SignalN(2)
+	if n := countWoke(woke); n != 2 {
+		t.Errorf("SignalN(2) woke %d waiters, expected 2", n)
+	}
+	b.SignalOne()
+	if n := countWoke(woke); n != 1 {
+		t.Errorf("SignalOne woke %d waiters, expected the last 1", n)
+	}
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after waking all, expected 0", waiters)
 	}
 }
 
-// contended (two only) wlock/wunlock only two because my lock fast track
-// returns on more than two
+func TestSignalN(t *testing.T) {
+	b := New()
+	woke := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		primer, _ := b.Prime(0)
+		go func() {
+			b.Wait(primer)
+			woke <- struct{}{}
+		}()
+	}
+	// Give the waiters time to go to sleep.
+	time.Sleep(20 * time.Millisecond)
 
-func BenchmarkLockW2(b *testing.B) {
-	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
-	var l lock
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if !l.TryLock() {
-				panic(fmt.Sprintf("%b", l.write))
+	count := func() (n int) {
+		for {
+			select {
+			case <-woke:
+				n++
+			case <-time.After(20 * time.Millisecond):
+				return n
 			}
-			l.WUnlock()
 		}
-	})
+	}
+	b.SignalOne()
+	if n := count(); n != 1 {
+		t.Errorf("SignalOne woke %d waiters, expected 1", n)
+	}
+	b.SignalN(2)
+	if n := count(); n != 2 {
+		t.Errorf("SignalN(2) woke %d waiters, expected 2", n)
+	}
+	b.SignalN(5)
+	if n := count(); n != 1 {
+		t.Errorf("SignalN(5) woke %d waiters, expected the last 1", n)
+	}
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after waking all, expected 0", waiters)
+	}
 }
 
-func BenchmarkRWMutexW2(b *testing.B) {
-	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
-	var mtx sync.RWMutex
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			mtx.Lock()
-			mtx.Unlock()
-		}
-	})
+// sleepers primes n waiters at b's current counter and returns a channel
+// each sends on when it wakes, after giving them time to go to sleep.
+func sleepers(b *Block, n int) chan struct{} {
+	woke := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		primer, _ := b.Prime(atomic.LoadUintptr(&b.counter))
+		go func() {
+			b.Wait(primer)
+			woke <- struct{}{}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	return woke
 }
 
-// very contended rlock/runlock (10 goroutines per proc).
-
-func BenchmarkLockR(b *testing.B) {
-	b.SetParallelism(10) // 10 goroutines per proc
-	var l lock
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if !l.TryRLock() {
-				panic(fmt.Sprintf("%b", l.write))
-			}
-			l.Unlock()
+// countWoke counts wakes on woke until none arrive for a while.
+func countWoke(woke chan struct{}) (n int) {
+	for {
+		select {
+		case <-woke:
+			n++
+		case <-time.After(20 * time.Millisecond):
+			return n
 		}
-	})
+	}
 }
 
-func BenchmarkRWMutexR(b *testing.B) {
-	b.SetParallelism(10)
-	var mtx sync.RWMutex
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			mtx.RLock()
-			mtx.RUnlock()
-		}
-	})
-}
+// TestSignalCoalescing checks that signals collapsing into a pending signal
+// of the other kind are neither lost nor leaked: a Signal collapsing into a
+// pending SignalOne still wakes everybody, and a SignalN collapsing into a
+// pending Signal does not leave wakes for a later SignalOne.
+func TestSignalCoalescing(t *testing.T) {
+	b := New()
+	woke := sleepers(b, 4)
+	// Holding the lock, as an active signal does, makes the first signal
+	// pend and the second collapse into it.
+	b.lock.TryLock()
+	go b.SignalOne()
+	for !b.lock.Pending() {
+		time.Sleep(time.Millisecond)
+	}
+	b.Signal()
+	b.lock.WUnlock()
+	if n := countWoke(woke); n != 4 {
+		t.Errorf("Signal collapsed into SignalOne woke %d waiters, expected 4", n)
+	}
 
-// very contended wlock/wunlock
+	woke = sleepers(b, 4)
+	b.lock.TryLock()
+	go b.Signal()
+	for !b.lock.Pending() {
+		time.Sleep(time.Millisecond)
+	}
+	b.SignalN(3)
+	b.lock.WUnlock()
+	if n := countWoke(woke); n != 4 {
+		t.Errorf("SignalN collapsed into Signal woke %d waiters, expected 4", n)
+	}
 
-func BenchmarkLockW(b *testing.B) {
-	b.SetParallelism(10)
-	var l lock
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if l.TryLock() {
-				l.WUnlock()
-			}
-		}
-	})
+	woke = sleepers(b, 4)
+	b.SignalOne()
+	if n := countWoke(woke); n != 1 {
+		t.Errorf("SignalOne after a collapsed SignalN woke %d waiters, expected 1", n)
+	}
+	b.Signal()
+	countWoke(woke)
 }
 
-func BenchmarkRWMutexW(b *testing.B) {
-	b.SetParallelism(10)
-	var mtx sync.RWMutex
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			mtx.Lock()
-			mtx.Unlock()
-		}
-	})
+func TestStats(t *testing.T) {
+	if s := New().Stats(); s != (Stats{}) {
+		t.Errorf("got stats %+v without NewStats, expected zero", s)
+	}
+
+	b := NewStats()
+	b.Signal() // no waiters, not counted
+	primer, _ := b.Prime(0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Signal()
+	}()
+	b.Wait(primer)
+
+	// Hold the lock so that one signal pends and the next coalesces.
+	primer, _ = b.Prime(b.counter)
+	b.lock.TryLock()
+	go b.Signal()
+	for !b.lock.Pending() {
+		time.Sleep(time.Millisecond)
+	}
+	b.Signal()
+	b.lock.WUnlock()
+	b.Wait(primer)
+
+	s := b.Stats()
+	if s.Primes != 2 || s.Primed != 2 || s.Waits != 2 || s.Signals != 3 || s.Coalesced != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if s.EarlyReturns+s.Parks < 2 || s.Parks == 0 {
+		t.Errorf("expected a park and every wait to park or return early, got %+v", s)
+	}
+	var parked uint64
+	for _, n := range s.Parked {
+		parked += n
+	}
+	if parked != s.Parks {
+		t.Errorf("got %d parks in the histogram, expected %d", parked, s.Parks)
+	}
 }
 
-// very contended competing wlock/wunlock and rlock/unlock
+func TestChan(t *testing.T) {
+	b := New()
+	primer, _ := b.Prime(0)
+	c := b.Chan(primer)
+	select {
+	case <-c:
+		t.Fatal("channel closed before signal")
+	case <-time.After(10 * time.Millisecond):
+	}
+	go b.SignalOne()
+	select {
+	case <-c:
+	case <-time.After(time.Minute):
+		t.Fatal("channel not closed after signal")
+	}
+	b.Cancel()
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after Cancel, expected 0", waiters)
+	}
 
-func BenchmarkLockRW(b *testing.B) {
-	b.SetParallelism(10)
-	var l lock
-	b.RunParallel(func(pb *testing.PB) {
-		full := true
-		for pb.Next() {
-			if full {
-				if l.TryLock() {
-					l.WUnlock()
-				}
-			} else {
-				if l.TryRLock() {
-					l.Unlock()
-				}
-			}
-			full = !full
-		}
-	})
+	// A signal between Prime and Chan must not be missed.
+	primer, _ = b.Prime(b.counter)
+	b.Signal()
+	select {
+	case <-b.Chan(primer):
+	default:
+		t.Error("channel not closed after signal before Chan")
+	}
+	b.Cancel()
 }
 
-func BenchmarkRWMutexRW(b *testing.B) {
-	b.SetParallelism(10)
-	var mtx sync.RWMutex
-	b.RunParallel(func(pb *testing.PB) {
-		full := true
-		for pb.Next() {
-			if full {
-				mtx.Lock()
-				mtx.Unlock()
-			} else {
-				mtx.RLock()
-				mtx.RUnlock()
-			}
-			full = !full
-		}
+func TestDo(t *testing.T) {
+	b := New()
+	var avail int32
+	done := make(chan struct{})
+	go func() {
+		b.Do(func() bool {
+			return atomic.CompareAndSwapInt32(&avail, 1, 0)
+		})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt32(&avail, 1)
+	b.Signal()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("Do did not return after signal")
+	}
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after Do, expected 0", waiters)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	b := New()
+	tries := 0
+	err := b.DoContext(context.Background(), func() bool {
+		tries++
+		return tries == 2 // succeed after priming, exercising Cancel
 	})
+	if err != nil {
+		t.Errorf("got %v on success, expected nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = b.DoContext(ctx, func() bool { return false })
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v after deadline, expected %v", err, context.DeadlineExceeded)
+	}
+	if waiters := atomic.LoadInt32(&b.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after expiry, expected 0", waiters)
+	}
 }
 
 // contended block, and the mutex/cond obvious implementation beneath
@@ -272,3 +416,92 @@ func BenchmarkMtxBlock(b *testing.B) {
 	})
 	close(die)
 }
+
+// BenchmarkHerd has 100 waiters taking single items of work, one item per op,
+// and reports how many times waiters woke per item. Between items, the
+// waiters go back to sleep. Signal wakes every sleeping waiter for each item,
+// while SignalOne wakes one.
+func BenchmarkHerd(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		signal func(*Block)
+	}{
+		{"Signal", (*Block).Signal},
+		{"SignalOne", (*Block).SignalOne},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			bl := New()
+			var items, wakeups int64
+			var done uint32
+			take := func() bool {
+				for {
+					n := atomic.LoadInt64(&items)
+					if n == 0 {
+						return false
+					}
+					if atomic.CompareAndSwapInt64(&items, n, n-1) {
+						return true
+					}
+				}
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for atomic.LoadUint32(&done) == 0 {
+						if take() {
+							continue
+						}
+						var primer uintptr
+						var primed, took bool
+						for !primed && !took {
+							primer, primed = bl.Prime(primer)
+							took = take()
+						}
+						if took {
+							if primed {
+								bl.Cancel()
+							}
+							continue
+						}
+						if atomic.LoadUint32(&done) != 0 {
+							bl.Cancel()
+							return
+						}
+						bl.Wait(primer)
+						atomic.AddInt64(&wakeups, 1)
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				atomic.AddInt64(&items, 1)
+				bench.signal(bl)
+				for atomic.LoadInt64(&items) != 0 {
+					runtime.Gosched()
+				}
+				// Let the waiters go back to sleep.
+				time.Sleep(100 * time.Microsecond)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&wakeups))/float64(b.N), "wakeups/op")
+
+			atomic.StoreUint32(&done, 1)
+			exited := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(exited)
+			}()
+			for {
+				bl.Signal()
+				select {
+				case <-exited:
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		})
+	}
+}
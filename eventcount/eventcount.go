@@ -0,0 +1,160 @@
+// This transliterates Dmitry Vyukov's eventcount,
+// www.1024cores.net/home/lock-free-algorithms/eventcounts.
+
+// Package eventcount provides an eventcount, a way to add blocking to
+// lock-free algorithms without changing the algorithms themselves.
+//
+// A waiter announces that it is about to wait with PrepareWait, re-checks its
+// condition, and then either calls CancelWait, if the condition is now true,
+// or CommitWait, which waits until a Notify after the PrepareWait:
+//
+//	for {
+//		if ptr, ok := q.TryDequeue(); ok {
+//			return ptr
+//		}
+//		key := ec.PrepareWait()
+//		if ptr, ok := q.TryDequeue(); ok {
+//			ec.CancelWait()
+//			return ptr
+//		}
+//		ec.CommitWait(key)
+//	}
+//
+// Notifiers call Notify or NotifyOne after every operation that can make a
+// waiter's condition true. If nobody is waiting, notifying is a single atomic
+// load.
+//
+// Unlike block.Block, waiters do not spin before sleeping, and a Notify is
+// never lost: a waiter that prepared before the Notify will not sleep, or
+// will be woken.
+//
+// EventCount also implements wait.Strategy: Do wraps the loop above, and
+// Signal and SignalOne are Notify and NotifyOne. This lets an EventCount
+// stand in for a block.Block in code that takes a strategy.
+package eventcount
+
+import (
+	"sync"
+
+	"github.com/twmb/dash/primitive"
+)
+
+// waiting is set in state while a waiter may be preparing to wait or
+// sleeping. The rest of state is the epoch, which every notification that
+// sees the waiting bit advances.
+const (
+	waiting  = 1
+	epochInc = 2
+)
+
+// EventCount wakes waiters when events happen.
+type EventCount struct {
+	_pad0 [primitive.FalseShare - 4]byte
+	state uint32
+	_pad1 [primitive.FalseShare - 4]byte
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	sleepers int
+}
+
+// New returns a new EventCount.
+func New() *EventCount {
+	ec := new(EventCount)
+	ec.cond.L = &ec.mu
+	return ec
+}
+
+// Key is the epoch a waiter prepared to wait in.
+type Key uint32
+
+// PrepareWait announces that the caller is about to wait, returning the key
+// to pass to CommitWait. After PrepareWait, the caller must re-check its
+// condition and then call either CancelWait or CommitWait.
+func (ec *EventCount) PrepareWait() Key {
+	state := primitive.LoadUint32(&ec.state)
+	for state&waiting == 0 {
+		state, _ = primitive.CompareAndSwapUint32(&ec.state, state, state|waiting)
+	}
+	return Key(state &^ waiting)
+}
+
+// CancelWait cancels a PrepareWait whose caller no longer needs to wait.
+//
+// The waiting bit PrepareWait set cannot be cleared, as other waiters may
+// have prepared since; the next notification clears it. CancelWait is a
+// no-op, provided so that every PrepareWait pairs with a call.
+func (ec *EventCount) CancelWait() {}
+
+// CommitWait waits until a notification after the PrepareWait that returned
+// key. If a notification already happened, CommitWait returns immediately.
+func (ec *EventCount) CommitWait(key Key) {
+	ec.mu.Lock()
+	for Key(primitive.LoadUint32(&ec.state)&^waiting) == key {
+		ec.sleepers++
+		ec.cond.Wait()
+		ec.sleepers--
+	}
+	ec.mu.Unlock()
+}
+
+// Notify wakes every waiter.
+func (ec *EventCount) Notify() {
+	if primitive.LoadUint32(&ec.state)&waiting == 0 {
+		return
+	}
+	ec.mu.Lock()
+	ec.advance(false)
+	ec.mu.Unlock()
+	ec.cond.Broadcast()
+}
+
+// NotifyOne wakes one sleeping waiter. Waiters that have prepared but are not
+// yet sleeping return from CommitWait immediately, as with Notify.
+func (ec *EventCount) NotifyOne() {
+	if primitive.LoadUint32(&ec.state)&waiting == 0 {
+		return
+	}
+	ec.mu.Lock()
+	// Any sleepers we do not wake still need a later notification to
+	// look at them, so we keep the waiting bit.
+	ec.advance(ec.sleepers > 1)
+	ec.mu.Unlock()
+	ec.cond.Signal()
+}
+
+// advance moves to the next epoch, clearing the waiting bit unless keep is
+// set. Waiters that prepared in the old epoch will not sleep, or will return
+// once woken.
+func (ec *EventCount) advance(keep bool) {
+	state := primitive.LoadUint32(&ec.state)
+	for {
+		next := state&^waiting + epochInc
+		if keep {
+			next |= waiting
+		}
+		var swapped bool
+		if state, swapped = primitive.CompareAndSwapUint32(&ec.state, state, next); swapped {
+			return
+		}
+	}
+}
+
+// Do calls try until it returns true, waiting on the eventcount between
+// attempts that fail.
+func (ec *EventCount) Do(try func() bool) {
+	for !try() {
+		key := ec.PrepareWait()
+		if try() {
+			ec.CancelWait()
+			return
+		}
+		ec.CommitWait(key)
+	}
+}
+
+// Signal is Notify, for use as a wait.Strategy.
+func (ec *EventCount) Signal() { ec.Notify() }
+
+// SignalOne is NotifyOne, for use as a wait.Strategy.
+func (ec *EventCount) SignalOne() { ec.NotifyOne() }
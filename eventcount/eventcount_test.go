@@ -0,0 +1,158 @@
+package eventcount
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+)
+
+func TestNotifyWithoutWaiters(t *testing.T) {
+	ec := New()
+	ec.Notify()
+	ec.NotifyOne()
+	if ec.state != 0 {
+		t.Errorf("got state %d after notifying nobody, expected 0", ec.state)
+	}
+}
+
+func TestCommitAfterNotify(t *testing.T) {
+	ec := New()
+	key := ec.PrepareWait()
+	ec.Notify()
+	done := make(chan struct{})
+	go func() {
+		ec.CommitWait(key)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CommitWait slept through a notification after PrepareWait")
+	}
+	if ec.state&waiting != 0 {
+		t.Error("waiting bit still set after Notify")
+	}
+}
+
+// sleep starts n waiters and waits for them all to sleep, returning a channel
+// that receives as each wakes.
+func sleep(ec *EventCount, n int) chan struct{} {
+	woke := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		key := ec.PrepareWait()
+		go func() {
+			ec.CommitWait(key)
+			woke <- struct{}{}
+		}()
+	}
+	for {
+		ec.mu.Lock()
+		sleepers := ec.sleepers
+		ec.mu.Unlock()
+		if sleepers == n {
+			return woke
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func count(woke chan struct{}) (n int) {
+	for {
+		select {
+		case <-woke:
+			n++
+		case <-time.After(20 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	ec := New()
+	woke := sleep(ec, 3)
+	ec.Notify()
+	if n := count(woke); n != 3 {
+		t.Errorf("Notify woke %d waiters, expected 3", n)
+	}
+}
+
+func TestNotifyOne(t *testing.T) {
+	ec := New()
+	woke := sleep(ec, 3)
+	ec.NotifyOne()
+	if n := count(woke); n != 1 {
+		t.Errorf("NotifyOne woke %d waiters, expected 1", n)
+	}
+	ec.NotifyOne()
+	if n := count(woke); n != 1 {
+		t.Errorf("second NotifyOne woke %d waiters, expected 1", n)
+	}
+	ec.Notify()
+	if n := count(woke); n != 1 {
+		t.Errorf("Notify woke %d waiters, expected the last 1", n)
+	}
+	if ec.state&waiting != 0 {
+		t.Error("waiting bit still set with nobody waiting")
+	}
+}
+
+// TestQueue passes values through a small queue, blocking on full and empty
+// with eventcounts.
+func TestQueue(t *testing.T) {
+	const producers, consumers, per = 4, 4, 20000
+	q := mpmcdvq.New(4)
+	notFull, notEmpty := New(), New()
+
+	var wg sync.WaitGroup
+	var sum int64
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= per; j++ {
+				j := j
+				v := unsafe.Pointer(&j)
+				for !q.TryEnqueue(v) {
+					key := notFull.PrepareWait()
+					if q.TryEnqueue(v) {
+						notFull.CancelWait()
+						break
+					}
+					notFull.CommitWait(key)
+				}
+				notEmpty.NotifyOne()
+			}
+		}()
+	}
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < producers*per/consumers; j++ {
+				var v unsafe.Pointer
+				var ok bool
+				for {
+					if v, ok = q.TryDequeue(); ok {
+						break
+					}
+					key := notEmpty.PrepareWait()
+					if v, ok = q.TryDequeue(); ok {
+						notEmpty.CancelWait()
+						break
+					}
+					notEmpty.CommitWait(key)
+				}
+				atomic.AddInt64(&sum, int64(*(*int)(v)))
+				notFull.NotifyOne()
+			}
+		}()
+	}
+	wg.Wait()
+	if want := int64(producers * per * (per + 1) / 2); sum != want {
+		t.Errorf("got sum %d, expected %d", sum, want)
+	}
+}
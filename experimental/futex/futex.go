@@ -26,7 +26,7 @@ type Futex struct {
 
 func New() *Futex {
 	f := new(Futex)
-	f.origAddr = uintptr(unsafe.Pointer(&f))
+	f.origAddr = uintptr(unsafe.Pointer(f))
 	f.bucket = buckets[twhash(uint64(f.origAddr))%numBuckets]
 	return f
 }
@@ -7,13 +7,16 @@ package follyq
 
 import (
 	"reflect"
-	"sync/atomic"
 	"unsafe"
 
-	"github.com/twmb/dash/futex"
+	"github.com/twmb/dash/experimental/futex"
 	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/spin"
 )
 
+var _ queue.BlockingQueue = (*Queue)(nil)
+
 const (
 	upSz      = unsafe.Sizeof(uintptr(0))
 	cellSz    = unsafe.Sizeof(cell{})
@@ -38,13 +41,13 @@ func (c *cell) mayDequeue(turn uintptr) bool {
 	return c.tb.isTurn(turn*2 + 1)
 }
 
-func (c *cell) enqueue(turn uintptr, ptr unsafe.Pointer, spinCutoff *uint32, maybeUpdateSpin bool) {
+func (c *cell) enqueue(turn uintptr, ptr unsafe.Pointer, spinCutoff *spin.Cutoff, maybeUpdateSpin bool) {
 	c.tb.waitFor(turn*2, spinCutoff, maybeUpdateSpin)
 	c.ptr = ptr
 	c.tb.completeTurn(turn * 2)
 }
 
-func (c *cell) dequeue(turn uintptr, spinCutoff *uint32, maybeUpdateSpin bool) (ptr unsafe.Pointer) {
+func (c *cell) dequeue(turn uintptr, spinCutoff *spin.Cutoff, maybeUpdateSpin bool) (ptr unsafe.Pointer) {
 	c.tb.waitFor(turn*2+1, spinCutoff, maybeUpdateSpin)
 	ptr = c.ptr
 	c.ptr = null
@@ -72,11 +75,11 @@ type Queue struct {
 	popTicket uintptr
 	_pad3     [cacheLine - upSz]byte
 	// pushSpinCutoff is used to control spinning when enqueueing.
-	pushSpinCutoff uint32
-	_pad4          [cacheLine - 4]byte
+	pushSpinCutoff spin.Cutoff
+	_pad4          [cacheLine - unsafe.Sizeof(spin.Cutoff{})]byte
 	// popSpinCutoff is used to control spinning when dequeueing.
-	popSpinCutoff uint32
-	_pad5         [cacheLine - 4]byte
+	popSpinCutoff spin.Cutoff
+	_pad5         [cacheLine - unsafe.Sizeof(spin.Cutoff{})]byte
 }
 
 // next2 rounds up to the next power of 2 by setting all bits at or under the
@@ -118,7 +121,7 @@ func (q *Queue) TryEnqueue(ptr unsafe.Pointer) (enqueued bool) {
 }
 
 func (q *Queue) Enqueue(ptr unsafe.Pointer) {
-	nextTicket := atomic.AddUintptr(&q.pushTicket, 1)
+	nextTicket := primitive.AddUintptr(&q.pushTicket, 1)
 	q.enqueue(nextTicket-1, ptr)
 }
 
@@ -132,14 +135,14 @@ func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
 }
 
 func (q *Queue) Dequeue() (ptr unsafe.Pointer) {
-	nextTicket := atomic.AddUintptr(&q.popTicket, 1)
+	nextTicket := primitive.AddUintptr(&q.popTicket, 1)
 	return q.dequeue(nextTicket - 1)
 }
 
 // tryGetPushTicket tries to obtain a push ticket for which an enqueue will not
 // block.
 func (q *Queue) tryGetPushTicket() (uintptr, bool) {
-	curPush := atomic.LoadUintptr(&q.pushTicket)
+	curPush := primitive.LoadUintptr(&q.pushTicket)
 	for {
 		c := (*cell)(unsafe.Pointer(uintptr(q.cellsPtr) + (cellSz * (curPush & q.mask))))
 		if !c.mayEnqueue(curPush >> q.lgsz) {
@@ -148,7 +151,7 @@ func (q *Queue) tryGetPushTicket() (uintptr, bool) {
 			// increase tryGetPushTicket under contention by
 			// rechecking before failing.
 			prev := curPush
-			curPush = atomic.LoadUintptr(&q.pushTicket)
+			curPush = primitive.LoadUintptr(&q.pushTicket)
 			if prev == curPush {
 				// We checked and failed twice. We cannot
 				// enqueue.
@@ -157,32 +160,32 @@ func (q *Queue) tryGetPushTicket() (uintptr, bool) {
 		} else {
 			// We _think_ we have a push ticket that can enqueue,
 			// but now swap this local state in to claim our spot.
-			var swapped bool
-			curPush, swapped = primitive.CompareAndSwapUintptr(&q.pushTicket, curPush, curPush+1)
+			fresh, swapped := primitive.CompareAndSwapUintptr(&q.pushTicket, curPush, curPush+1)
 			if swapped {
 				return curPush, true
 			}
+			curPush = fresh
 		}
 	}
 }
 
 // tryGetPopTicket is analogous to tryGetPushTicket.
 func (q *Queue) tryGetPopTicket() (uintptr, bool) {
-	curPop := atomic.LoadUintptr(&q.popTicket)
+	curPop := primitive.LoadUintptr(&q.popTicket)
 	for {
 		c := (*cell)(unsafe.Pointer(uintptr(q.cellsPtr) + (cellSz * (curPop & q.mask))))
 		if !c.mayDequeue(curPop >> q.lgsz) {
 			prev := curPop
-			curPop = atomic.LoadUintptr(&q.popTicket)
+			curPop = primitive.LoadUintptr(&q.popTicket)
 			if prev == curPop {
 				return 0, false
 			}
 		} else {
-			var swapped bool
-			curPop, swapped = primitive.CompareAndSwapUintptr(&q.popTicket, curPop, curPop+1)
+			fresh, swapped := primitive.CompareAndSwapUintptr(&q.popTicket, curPop, curPop+1)
 			if swapped {
 				return curPop, true
 			}
+			curPop = fresh
 		}
 	}
 }
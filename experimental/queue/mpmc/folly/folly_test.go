@@ -0,0 +1,17 @@
+package follyq_test
+
+import (
+	"testing"
+
+	follyq "github.com/twmb/dash/experimental/queue/mpmc/folly"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/queuetest"
+)
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, queuetest.Config{
+		New:       func(size uint) queue.TryQueue { return follyq.New(size) },
+		Producers: 4,
+		Consumers: 4,
+	})
+}
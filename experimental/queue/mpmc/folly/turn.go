@@ -2,22 +2,15 @@ package follyq
 
 import (
 	"math"
-	"sync/atomic"
 
-	"github.com/twmb/dash/futex"
+	"github.com/twmb/dash/experimental/futex"
 	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/spin"
 )
 
 const (
 	turnShift    = 6
 	turnWaitMask = 1<<turnShift - 1
-
-	// minSpins is the minimum spin count that we will update a remote spin
-	// cutoff to.
-	minSpins = 4
-	// maxSpins is the maximum spin count that we will update a remote spin
-	// cutoff to, and the count we use when probing for updating.
-	maxSpins = 2000
 )
 
 type turnBroker struct {
@@ -25,18 +18,14 @@ type turnBroker struct {
 }
 
 func (t turnBroker) isTurn(turn uintptr) bool {
-	return getTurnNumber(atomic.LoadUintptr(&t.f.State)) == turn
+	return getTurnNumber(primitive.LoadUintptr(&t.f.State)) == turn
 }
 
-func (t turnBroker) waitFor(turn uintptr, spinCutoff *uint32, updateSpinCutoff bool) {
-	givenSpinCount := atomic.LoadUint32(spinCutoff)
-	spinCount := givenSpinCount
-	if updateSpinCutoff || givenSpinCount == 0 {
-		spinCount = maxSpins
-	}
+func (t turnBroker) waitFor(turn uintptr, spinCutoff *spin.Cutoff, updateSpinCutoff bool) {
+	spinCount, learn := spinCutoff.Budget(updateSpinCutoff)
 
 	var tries uint32
-	state := atomic.LoadUintptr(&t.f.State)
+	state := primitive.LoadUintptr(&t.f.State)
 	for ; ; tries++ {
 		curTurn := getTurnNumber(state)
 		if curTurn == turn {
@@ -50,7 +39,7 @@ func (t turnBroker) waitFor(turn uintptr, spinCutoff *uint32, updateSpinCutoff b
 
 		if tries < spinCount {
 			primitive.Pause()
-			state = atomic.LoadUintptr(&t.f.State)
+			state = primitive.LoadUintptr(&t.f.State)
 			continue
 		}
 
@@ -73,44 +62,17 @@ func (t turnBroker) waitFor(turn uintptr, spinCutoff *uint32, updateSpinCutoff b
 		}
 
 		t.f.Wait(newState, futexChannel(turn))
-		state = atomic.LoadUintptr(&t.f.State)
+		state = primitive.LoadUintptr(&t.f.State)
 	}
 
-	if updateSpinCutoff || givenSpinCount == 0 {
-		var spinUpdate uint32
-		if tries >= maxSpins {
-			// If we hit maxSpins, then spinning is pointless, so
-			// the right spinCutoff is the minimum possible.
-			spinUpdate = minSpins
-		} else {
-			// To account for variations, we allow ourself to spin
-			// 2*N when we think that N is actually required in
-			// order to succeed.
-			spinUpdate = minSpins
-			dubTries := tries << 1
-			if dubTries > spinUpdate {
-				spinUpdate = dubTries
-			}
-			if maxSpins < spinUpdate {
-				spinUpdate = maxSpins
-			}
-		}
-		if givenSpinCount == 0 {
-			atomic.StoreUint32(spinCutoff, spinUpdate)
-		} else {
-			// Per Facebook, "Exponential moving average with alpha
-			// of 7/8"... k.
-			spinUpdate = uint32(int(givenSpinCount) + (int(spinUpdate)-int(givenSpinCount))>>3)
-			// Try once but keep moving if somebody else updated.
-			atomic.CompareAndSwapUint32(spinCutoff, givenSpinCount,
-				spinUpdate)
-		}
+	if learn {
+		spinCutoff.Learn(tries)
 	}
 }
 
 // completeTurn unblocks a thread running waitFor(turn + 1).
 func (t turnBroker) completeTurn(turn uintptr) {
-	state := atomic.LoadUintptr(&t.f.State)
+	state := primitive.LoadUintptr(&t.f.State)
 	for {
 		curWaitingFor := getTurnWait(state)
 		var oneLess uintptr
@@ -0,0 +1,45 @@
+//go:build dashsched
+// +build dashsched
+
+package follyq
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/twmb/dash/experimental/futex"
+	"github.com/twmb/dash/sched"
+	"github.com/twmb/dash/spin"
+)
+
+// TestTurnSchedules explores three threads taking consecutive turns, checking
+// that the turns run in order and the broker ends on the next turn.
+func TestTurnSchedules(t *testing.T) {
+	err := sched.Explore(sched.Config{}, func() sched.Scenario {
+		tb := turnBroker{f: futex.New()}
+		var spinCutoff spin.Cutoff
+		var order []uintptr
+		take := func(turn uintptr) func() {
+			return func() {
+				tb.waitFor(turn, &spinCutoff, false)
+				order = append(order, turn)
+				tb.completeTurn(turn)
+			}
+		}
+		return sched.Scenario{
+			Threads: []func(){take(2), take(0), take(1)},
+			Check: func() error {
+				if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+					return fmt.Errorf("turns ran in order %v", order)
+				}
+				if !tb.isTurn(3) {
+					return fmt.Errorf("broker state %x is not on turn 3", tb.f.State)
+				}
+				return nil
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+// Package mutex provides an adaptive mutex that spins for a learned number of
+// spins before parking.
+//
+// A Mutex spins while waiting for the lock for as long as waits usually take,
+// learning that number with a spin.Cutoff, the same estimate folly's MPMCQueue
+// uses. If the lock is usually held briefly, waiters spin and never pay for
+// parking and waking; if it is usually held for long, waiters quickly stop
+// spinning and park on a futex. Unlocking only wakes a parked waiter if
+// somebody has parked.
+//
+// This uses the emulated futex from experimental/futex.
+package mutex
+
+import (
+	"sync"
+
+	"github.com/twmb/dash/experimental/futex"
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/spin"
+)
+
+var _ sync.Locker = (*Mutex)(nil)
+
+// The states of a Mutex's futex.
+const (
+	unlocked uintptr = iota
+	locked
+	// contended is locked with waiters that may have parked.
+	contended
+)
+
+// allWaiters is the futex wait mask every Mutex waiter uses.
+const allWaiters = ^uintptr(0)
+
+// probeFreqMask sets how often contended locks probe to update the spin
+// cutoff: once every probeFreqMask+1 contended locks.
+const probeFreqMask = 1<<7 - 1
+
+// Mutex is an adaptive mutual exclusion lock.
+type Mutex struct {
+	f      *futex.Futex
+	cutoff spin.Cutoff
+	// waits counts contended locks, deciding which probe.
+	waits uint32
+}
+
+// New returns a new, unlocked Mutex.
+func New() *Mutex {
+	return &Mutex{f: futex.New()}
+}
+
+// TryLock locks m if it is unlocked, returning whether it did.
+func (m *Mutex) TryLock() bool {
+	_, swapped := primitive.CompareAndSwapUintptr(&m.f.State, unlocked, locked)
+	return swapped
+}
+
+// Lock locks m, spinning and then parking while m is locked.
+func (m *Mutex) Lock() {
+	if m.TryLock() {
+		return
+	}
+	probe := primitive.AddUint32(&m.waits, 1)&probeFreqMask == 0
+	spins, learn := m.cutoff.Budget(probe)
+
+	var tries uint32
+	for ; ; tries++ {
+		state := primitive.LoadUintptr(&m.f.State)
+		if tries < spins {
+			if state == unlocked {
+				if _, swapped := primitive.CompareAndSwapUintptr(&m.f.State, unlocked, locked); swapped {
+					break
+				}
+			}
+			primitive.Pause()
+			continue
+		}
+
+		// Done spinning, we mark the lock contended so that the unlocker
+		// wakes us. If the lock was unlocked, we lock it contended,
+		// which may cause a needless wake, but never a missed one.
+		if state != contended {
+			if _, swapped := primitive.CompareAndSwapUintptr(&m.f.State, state, contended); !swapped {
+				continue
+			}
+			if state == unlocked {
+				break
+			}
+		}
+		m.f.Wait(contended, allWaiters)
+	}
+
+	if learn {
+		m.cutoff.Learn(tries)
+	}
+}
+
+// Unlock unlocks m. As with sync.Mutex, m may be unlocked by a goroutine
+// other than the one that locked it. It is a run-time error if m is not
+// locked.
+func (m *Mutex) Unlock() {
+	state := primitive.LoadUintptr(&m.f.State)
+	for {
+		if state == unlocked {
+			panic("mutex: unlock of unlocked mutex")
+		}
+		fresh, swapped := primitive.CompareAndSwapUintptr(&m.f.State, state, unlocked)
+		if swapped {
+			break
+		}
+		state = fresh
+	}
+	if state == contended {
+		m.f.Wake(1, allWaiters)
+	}
+}
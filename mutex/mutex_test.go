@@ -0,0 +1,173 @@
+package mutex
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/spin"
+)
+
+func TestTryLock(t *testing.T) {
+	m := New()
+	if !m.TryLock() {
+		t.Fatal("unable to TryLock unlocked mutex")
+	}
+	if m.TryLock() {
+		t.Fatal("unexpected TryLock of locked mutex")
+	}
+	m.Unlock()
+	if !m.TryLock() {
+		t.Fatal("unable to TryLock after Unlock")
+	}
+	m.Unlock()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic unlocking unlocked mutex")
+		}
+	}()
+	m.Unlock()
+}
+
+// TestExclusion checks that goroutines incrementing under the lock never
+// lose an increment, with critical sections both short enough to spin
+// through and long enough to park.
+func TestExclusion(t *testing.T) {
+	for _, work := range []int{0, 100} {
+		const goroutines, per = 8, 2000
+		m := New()
+		var n int
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < per; j++ {
+					m.Lock()
+					n++
+					for k := 0; k < work; k++ {
+						if k%10 == 0 {
+							runtime.Gosched()
+						}
+					}
+					m.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if n != goroutines*per {
+			t.Errorf("work %d: got %d increments, expected %d", work, n, goroutines*per)
+		}
+		// Yielding under the lock guarantees contention; without work,
+		// a single proc may never contend.
+		if work > 0 && m.cutoff.Spins() == 0 {
+			t.Errorf("work %d: spin cutoff not learned under contention", work)
+		}
+	}
+}
+
+// TestParkMany checks that waiters parked on different Mutexes at once are
+// each woken by unlocking their own Mutex, first with one waiter parked per
+// Mutex and then with several Mutexes contended at once.
+func TestParkMany(t *testing.T) {
+	const mutexes = 4
+	ms := make([]*Mutex, mutexes)
+	for i := range ms {
+		ms[i] = New()
+		// Learning a useless spin leaves a short spin budget, so that
+		// waiters park quickly.
+		ms[i].cutoff.Learn(spin.MaxSpins)
+	}
+
+	// Park a waiter on each mutex, last mutex first, and then unlock them
+	// first mutex first: each unlock must wake its own waiter, not the
+	// one that parked earliest.
+	locked := make([]chan struct{}, mutexes)
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		m.Lock()
+		locked[i] = make(chan struct{})
+		go func(done chan struct{}) {
+			m.Lock()
+			close(done)
+		}(locked[i])
+		for primitive.LoadUintptr(&m.f.State) != contended {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i, m := range ms {
+		m.Unlock()
+		select {
+		case <-locked[i]:
+		case <-time.After(time.Second):
+			t.Fatalf("unlocking mutex %d did not wake its parked waiter", i)
+		}
+		m.Unlock()
+	}
+
+	const goroutines, per = 4, 500
+	counts := make([]int, mutexes)
+	var wg sync.WaitGroup
+	for i := range ms {
+		for j := 0; j < goroutines; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for k := 0; k < per; k++ {
+					ms[i].Lock()
+					counts[i]++
+					// Yield under the lock so that others park.
+					runtime.Gosched()
+					ms[i].Unlock()
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	for i, n := range counts {
+		if n != goroutines*per {
+			t.Errorf("mutex %d: got %d increments, expected %d", i, n, goroutines*per)
+		}
+	}
+}
+
+// These benchmarks compare the adaptive mutex against sync.Mutex with a
+// short critical section, at increasing GOMAXPROCS with 10 goroutines per
+// proc.
+
+var benchProcs = []int{8, 32, 64}
+
+func benchLocker(b *testing.B, l sync.Locker) {
+	var n int
+	b.SetParallelism(10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Lock()
+			n++
+			l.Unlock()
+		}
+	})
+}
+
+func BenchmarkMutex(b *testing.B) {
+	for _, procs := range benchProcs {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			benchLocker(b, New())
+		})
+	}
+}
+
+func BenchmarkSyncMutex(b *testing.B) {
+	for _, procs := range benchProcs {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			benchLocker(b, new(sync.Mutex))
+		})
+	}
+}
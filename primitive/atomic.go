@@ -0,0 +1,54 @@
+//go:build !dashsched
+// +build !dashsched
+
+package primitive
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// The functions below wrap sync/atomic and runtime.Gosched. Code using them
+// instead of calling sync/atomic directly can be explored with the sched
+// package by building with the dashsched tag.
+
+// LoadInt32 atomically loads *addr.
+func LoadInt32(addr *int32) int32 { return atomic.LoadInt32(addr) }
+
+// LoadInt64 atomically loads *addr.
+func LoadInt64(addr *int64) int64 { return atomic.LoadInt64(addr) }
+
+// LoadUint32 atomically loads *addr.
+func LoadUint32(addr *uint32) uint32 { return atomic.LoadUint32(addr) }
+
+// LoadUintptr atomically loads *addr.
+func LoadUintptr(addr *uintptr) uintptr { return atomic.LoadUintptr(addr) }
+
+// StoreInt32 atomically stores val into *addr.
+func StoreInt32(addr *int32, val int32) { atomic.StoreInt32(addr, val) }
+
+// StoreUint32 atomically stores val into *addr.
+func StoreUint32(addr *uint32, val uint32) { atomic.StoreUint32(addr, val) }
+
+// StoreUintptr atomically stores val into *addr.
+func StoreUintptr(addr *uintptr, val uintptr) { atomic.StoreUintptr(addr, val) }
+
+// AddInt32 atomically adds delta to *addr and returns the new value.
+func AddInt32(addr *int32, delta int32) int32 { return atomic.AddInt32(addr, delta) }
+
+// AddInt64 atomically adds delta to *addr and returns the new value.
+func AddInt64(addr *int64, delta int64) int64 { return atomic.AddInt64(addr, delta) }
+
+// AddUint32 atomically adds delta to *addr and returns the new value.
+func AddUint32(addr *uint32, delta uint32) uint32 { return atomic.AddUint32(addr, delta) }
+
+// AddUintptr atomically adds delta to *addr and returns the new value.
+func AddUintptr(addr *uintptr, delta uintptr) uintptr { return atomic.AddUintptr(addr, delta) }
+
+// SwapInt32 atomically stores new into *addr and returns the old value.
+func SwapInt32(addr *int32, new int32) int32 { return atomic.SwapInt32(addr, new) }
+
+// Gosched yields the processor, like runtime.Gosched. Spin loops waiting on
+// other goroutines should use Gosched (or Pause) so that schedule exploration
+// knows they are spinning.
+func Gosched() { runtime.Gosched() }
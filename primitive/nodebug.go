@@ -0,0 +1,8 @@
+//go:build !dashdebug
+// +build !dashdebug
+
+package primitive
+
+// Debug is true when building with the dashdebug tag, enabling (slow) checks
+// for misuse of dash types.
+const Debug = false
@@ -22,8 +22,12 @@ const (
 // holding unsafe.Pointers.
 var Null unsafe.Pointer
 
-// Next2 returns v rounded up to the next power of 2.
+// Next2 returns v rounded up to the next power of 2. Next2(0) is 1, and values
+// above the largest power of 2 wrap to 0.
 func Next2(v uintptr) uintptr {
+	if v == 0 {
+		return 1
+	}
 	v--
 	for i := uintptr(1); i < UpSz<<3; i <<= 1 {
 		v |= v >> i
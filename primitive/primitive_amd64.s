@@ -1,5 +1,5 @@
 // +build amd64
-// +build !race
+// +build !race,!dashsched
 
 #define NOSPLIT 4
 
@@ -41,3 +41,7 @@ TEXT ·CompareAndSwapUint32(SB), NOSPLIT, $0-21
 swapped:
 	MOVL CX, fresh+16(FP)
 	RET
+
+TEXT ·Pause(SB), NOSPLIT, $0-0
+	PAUSE
+	RET
@@ -1,4 +1,4 @@
-// +build race
+// +build race,!dashsched
 
 package primitive
 
@@ -68,3 +68,6 @@ func CompareAndSwapUint32(addr *uint32, old, new uint32) (fresh uint32, swapped
 	}
 	return
 }
+
+// Pause hints to the processor that the caller is in a spin loop.
+func Pause() {}
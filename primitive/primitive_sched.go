@@ -0,0 +1,147 @@
+//go:build dashsched
+// +build dashsched
+
+package primitive
+
+import (
+	"sync/atomic"
+
+	"github.com/twmb/dash/sched"
+)
+
+// With the dashsched tag, every atomic operation yields to the sched package
+// before running, letting sched choose which goroutine runs the operation
+// next.
+
+// CompareAndSwapUintptr executes the compare-and-swap operation for a uintptr
+// value, returning the freshest addr value after execution and whether the
+// CAS succeeded.
+func CompareAndSwapUintptr(addr *uintptr, old, new uintptr) (fresh uintptr, swapped bool) {
+	sched.Yield()
+	if swapped = atomic.CompareAndSwapUintptr(addr, old, new); swapped {
+		return new, true
+	}
+	return atomic.LoadUintptr(addr), false
+}
+
+// CompareAndSwapInt64 executes the compare-and-swap operation for a int64
+// value, returning the freshest addr value after execution and whether the CAS
+// succeeded.
+func CompareAndSwapInt64(addr *int64, old, new int64) (fresh int64, swapped bool) {
+	sched.Yield()
+	if swapped = atomic.CompareAndSwapInt64(addr, old, new); swapped {
+		return new, true
+	}
+	return atomic.LoadInt64(addr), false
+}
+
+// CompareAndSwapUint64 executes the compare-and-swap operation for a uint64
+// value, returning the freshest addr value after execution and whether the CAS
+// succeeded.
+func CompareAndSwapUint64(addr *uint64, old, new uint64) (fresh uint64, swapped bool) {
+	sched.Yield()
+	if swapped = atomic.CompareAndSwapUint64(addr, old, new); swapped {
+		return new, true
+	}
+	return atomic.LoadUint64(addr), false
+}
+
+// CompareAndSwapInt32 executes the compare-and-swap operation for an int32
+// value, returning the freshest addr value after execution and whether the CAS
+// succeeded.
+func CompareAndSwapInt32(addr *int32, old, new int32) (fresh int32, swapped bool) {
+	sched.Yield()
+	if swapped = atomic.CompareAndSwapInt32(addr, old, new); swapped {
+		return new, true
+	}
+	return atomic.LoadInt32(addr), false
+}
+
+// CompareAndSwapUint32 executes the compare-and-swap operation for a uint32
+// value, returning the freshest addr value after execution and whether the CAS
+// succeeded.
+func CompareAndSwapUint32(addr *uint32, old, new uint32) (fresh uint32, swapped bool) {
+	sched.Yield()
+	if swapped = atomic.CompareAndSwapUint32(addr, old, new); swapped {
+		return new, true
+	}
+	return atomic.LoadUint32(addr), false
+}
+
+// Pause tells the scheduler that the caller is in a spin loop.
+func Pause() { sched.Spin() }
+
+// LoadInt32 atomically loads *addr.
+func LoadInt32(addr *int32) int32 {
+	sched.YieldRead()
+	return atomic.LoadInt32(addr)
+}
+
+// LoadInt64 atomically loads *addr.
+func LoadInt64(addr *int64) int64 {
+	sched.YieldRead()
+	return atomic.LoadInt64(addr)
+}
+
+// LoadUint32 atomically loads *addr.
+func LoadUint32(addr *uint32) uint32 {
+	sched.YieldRead()
+	return atomic.LoadUint32(addr)
+}
+
+// LoadUintptr atomically loads *addr.
+func LoadUintptr(addr *uintptr) uintptr {
+	sched.YieldRead()
+	return atomic.LoadUintptr(addr)
+}
+
+// StoreInt32 atomically stores val into *addr.
+func StoreInt32(addr *int32, val int32) {
+	sched.Yield()
+	atomic.StoreInt32(addr, val)
+}
+
+// StoreUint32 atomically stores val into *addr.
+func StoreUint32(addr *uint32, val uint32) {
+	sched.Yield()
+	atomic.StoreUint32(addr, val)
+}
+
+// StoreUintptr atomically stores val into *addr.
+func StoreUintptr(addr *uintptr, val uintptr) {
+	sched.Yield()
+	atomic.StoreUintptr(addr, val)
+}
+
+// AddInt32 atomically adds delta to *addr and returns the new value.
+func AddInt32(addr *int32, delta int32) int32 {
+	sched.Yield()
+	return atomic.AddInt32(addr, delta)
+}
+
+// AddInt64 atomically adds delta to *addr and returns the new value.
+func AddInt64(addr *int64, delta int64) int64 {
+	sched.Yield()
+	return atomic.AddInt64(addr, delta)
+}
+
+// AddUint32 atomically adds delta to *addr and returns the new value.
+func AddUint32(addr *uint32, delta uint32) uint32 {
+	sched.Yield()
+	return atomic.AddUint32(addr, delta)
+}
+
+// AddUintptr atomically adds delta to *addr and returns the new value.
+func AddUintptr(addr *uintptr, delta uintptr) uintptr {
+	sched.Yield()
+	return atomic.AddUintptr(addr, delta)
+}
+
+// SwapInt32 atomically stores new into *addr and returns the old value.
+func SwapInt32(addr *int32, new int32) int32 {
+	sched.Yield()
+	return atomic.SwapInt32(addr, new)
+}
+
+// Gosched tells the scheduler that the caller is in a spin loop.
+func Gosched() { sched.Spin() }
@@ -1,5 +1,5 @@
 // +build amd64
-// +build !race
+// +build !race,!dashsched
 
 package primitive
 
@@ -27,3 +27,6 @@ func CompareAndSwapInt32(addr *int32, old, new int32) (fresh int32, swapped bool
 // value, returning the freshest addr value after execution and whether the CAS
 // succeeded.
 func CompareAndSwapUint32(addr *uint32, old, new uint32) (fresh uint32, swapped bool)
+
+// Pause hints to the processor that the caller is in a spin loop.
+func Pause()
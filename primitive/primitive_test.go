@@ -13,3 +13,29 @@ func TestCompareAndSwapUintptr(t *testing.T) {
 		t.Errorf("got %d (swapped %v), expected %d (swapped %v) from CAS of %d-value with %d to %d", fresh, swapped, 2, false, 2, 1, 3)
 	}
 }
+
+func FuzzNext2(f *testing.F) {
+	for _, v := range []uint64{0, 1, 2, 3, 4, 5, 1<<32 - 1, 1 << 32, 1<<63 - 1, 1 << 63, 1<<63 + 1, 1<<64 - 1} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v64 uint64) {
+		v := uintptr(v64)
+		if uint64(v) != v64 {
+			t.Skip("value does not fit in a uintptr")
+		}
+		got := Next2(v)
+		const top = 1 << (UpSz<<3 - 1)
+		if v > top {
+			if got != 0 {
+				t.Fatalf("Next2(%d) = %d, expected wraparound to 0", v, got)
+			}
+			return
+		}
+		if got == 0 || got&(got-1) != 0 {
+			t.Fatalf("Next2(%d) = %d, not a power of 2", v, got)
+		}
+		if got < v || got > 1 && got/2 >= v {
+			t.Fatalf("Next2(%d) = %d, not the next power of 2", v, got)
+		}
+	})
+}
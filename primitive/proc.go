@@ -0,0 +1,19 @@
+package primitive
+
+import _ "unsafe" // for go:linkname
+
+//go:linkname procPin runtime.procPin
+func procPin() int
+
+//go:linkname procUnpin runtime.procUnpin
+func procUnpin()
+
+// ProcHint returns the id of the P the calling goroutine is currently running
+// on. The goroutine is not kept pinned, meaning the returned id may be stale
+// by the time it is used; it is only a hint for spreading work across
+// per-CPU structures.
+func ProcHint() int {
+	p := procPin()
+	procUnpin()
+	return p
+}
@@ -0,0 +1,226 @@
+// Package backpressure wraps bounded queues with a configurable policy for
+// what to do when the queue is full.
+//
+// The dvq queues return failure from TryEnqueue when they are full, leaving
+// the reaction up to the caller. A Queue centralizes that reaction: it can
+// block until there is room, fail fast with ErrFull, drop the value being
+// enqueued, drop the oldest value in the queue, or spill into an unbounded
+// overflow list. Every Queue counts how often its policy kicked in, so that
+// operators can see what was dropped.
+//
+// Values must be dequeued through the Queue, not the wrapped queue: the
+// Queue wakes blocked enqueuers on dequeue, and drains the overflow list
+// once the wrapped queue is empty.
+package backpressure
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/wait"
+)
+
+// ErrFull is returned from Enqueue with the Fail policy when the queue is
+// full.
+var ErrFull = errors.New("backpressure: queue full")
+
+// Interface is the bounded queue a Queue wraps.
+type Interface = queue.TryQueue
+
+// Policy is what a Queue does when enqueueing into a full wrapped queue.
+type Policy int
+
+const (
+	// Block waits until a dequeue makes room.
+	Block Policy = iota
+	// Fail returns ErrFull. ErrFull is a plain sentinel error carrying
+	// no detail about which queue was full; check for it with errors.Is,
+	// and wrap it if the caller needs more context.
+	Fail
+	// DropNewest discards the value being enqueued.
+	DropNewest
+	// DropOldest dequeues and discards values from the wrapped queue until
+	// the value being enqueued fits. Because the enqueuer dequeues, the
+	// wrapped queue must support multiple concurrent dequeuers (mpmcdvq
+	// or spmcdvq).
+	DropOldest
+	// Spill appends the value to an unbounded overflow list. Once anything
+	// has spilled, all enqueues spill until the overflow list drains,
+	// which preserves the FIFO order of values from each enqueuer.
+	Spill
+)
+
+// Stats contains counts of how often a Queue's policy applied.
+type Stats struct {
+	// Enqueued is the number of values enqueued, including spilled values
+	// but not dropped values.
+	Enqueued uint64
+	// Blocked is the number of enqueues that had to wait for room.
+	Blocked uint64
+	// Failed is the number of enqueues that returned ErrFull.
+	Failed uint64
+	// DroppedNewest is the number of enqueued values dropped.
+	DroppedNewest uint64
+	// DroppedOldest is the number of queued values dropped to make room.
+	DroppedOldest uint64
+	// Spilled is the number of values appended to the overflow list.
+	Spilled uint64
+}
+
+// Queue wraps a bounded queue with a full-queue policy.
+type Queue struct {
+	q      Interface
+	policy Policy
+	onDrop func(unsafe.Pointer)
+	enqW   wait.Strategy
+	deqW   wait.Strategy
+
+	// spilled is the number of values in the overflow list, read
+	// atomically to avoid locking when nothing has spilled.
+	spilled  int64
+	spillMu  sync.Mutex
+	overflow []unsafe.Pointer
+	// head indexes the next value to dequeue from overflow.
+	head int
+
+	stats Stats
+}
+
+// New wraps q with the given policy. If onDrop is non-nil, it is called with
+// every value dropped by the DropNewest or DropOldest policies, allowing
+// callers to release dropped values.
+func New(q Interface, policy Policy, onDrop func(unsafe.Pointer)) *Queue {
+	return NewWait(q, policy, onDrop, block.New(), block.New())
+}
+
+// NewWait is New, waiting with the given strategies rather than blocks: enq
+// while the Block policy waits for room, and deq while Dequeue waits for a
+// value.
+func NewWait(q Interface, policy Policy, onDrop func(unsafe.Pointer), enq, deq wait.Strategy) *Queue {
+	return &Queue{
+		q:      q,
+		policy: policy,
+		onDrop: onDrop,
+		enqW:   enq,
+		deqW:   deq,
+	}
+}
+
+// Stats returns a snapshot of the counters for this queue.
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Enqueued:      atomic.LoadUint64(&q.stats.Enqueued),
+		Blocked:       atomic.LoadUint64(&q.stats.Blocked),
+		Failed:        atomic.LoadUint64(&q.stats.Failed),
+		DroppedNewest: atomic.LoadUint64(&q.stats.DroppedNewest),
+		DroppedOldest: atomic.LoadUint64(&q.stats.DroppedOldest),
+		Spilled:       atomic.LoadUint64(&q.stats.Spilled),
+	}
+}
+
+// Enqueue adds a value to the queue, applying the queue's policy if the
+// wrapped queue is full. Only the Fail policy returns an error.
+func (q *Queue) Enqueue(ptr unsafe.Pointer) error {
+	if q.policy == Spill && atomic.LoadInt64(&q.spilled) > 0 {
+		q.spill(ptr)
+		return nil
+	}
+	if q.q.TryEnqueue(ptr) {
+		q.enqueued()
+		return nil
+	}
+
+	switch q.policy {
+	case Block:
+		atomic.AddUint64(&q.stats.Blocked, 1)
+		q.block(ptr)
+	case Fail:
+		atomic.AddUint64(&q.stats.Failed, 1)
+		return ErrFull
+	case DropNewest:
+		atomic.AddUint64(&q.stats.DroppedNewest, 1)
+		q.drop(ptr)
+	case DropOldest:
+		for !q.q.TryEnqueue(ptr) {
+			if old, dequeued := q.q.TryDequeue(); dequeued {
+				atomic.AddUint64(&q.stats.DroppedOldest, 1)
+				q.drop(old)
+			}
+		}
+		q.enqueued()
+	case Spill:
+		q.spill(ptr)
+	}
+	return nil
+}
+
+func (q *Queue) enqueued() {
+	atomic.AddUint64(&q.stats.Enqueued, 1)
+	q.deqW.Signal()
+}
+
+func (q *Queue) drop(ptr unsafe.Pointer) {
+	if q.onDrop != nil {
+		q.onDrop(ptr)
+	}
+}
+
+// block retries enqueueing until it succeeds.
+func (q *Queue) block(ptr unsafe.Pointer) {
+	q.enqW.Do(func() bool { return q.q.TryEnqueue(ptr) })
+	q.enqueued()
+}
+
+func (q *Queue) spill(ptr unsafe.Pointer) {
+	q.spillMu.Lock()
+	q.overflow = append(q.overflow, ptr)
+	atomic.AddInt64(&q.spilled, 1)
+	q.spillMu.Unlock()
+	atomic.AddUint64(&q.stats.Spilled, 1)
+	q.enqueued()
+}
+
+// unspill dequeues from the overflow list.
+func (q *Queue) unspill() (ptr unsafe.Pointer, dequeued bool) {
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+	if q.head == len(q.overflow) {
+		return
+	}
+	ptr = q.overflow[q.head]
+	q.overflow[q.head] = nil
+	q.head++
+	if q.head == len(q.overflow) {
+		q.overflow = q.overflow[:0]
+		q.head = 0
+	}
+	atomic.AddInt64(&q.spilled, -1)
+	return ptr, true
+}
+
+// TryDequeue dequeues a value from the wrapped queue, or from the overflow
+// list if the wrapped queue is empty. If both are empty, this will return
+// failure.
+func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	if ptr, dequeued = q.q.TryDequeue(); !dequeued && atomic.LoadInt64(&q.spilled) > 0 {
+		ptr, dequeued = q.unspill()
+	}
+	if dequeued {
+		q.enqW.Signal()
+	}
+	return
+}
+
+// Dequeue dequeues a value, blocking while the queue is empty.
+func (q *Queue) Dequeue() unsafe.Pointer {
+	var deq unsafe.Pointer
+	q.deqW.Do(func() (dequeued bool) {
+		deq, dequeued = q.TryDequeue()
+		return
+	})
+	return deq
+}
@@ -0,0 +1,130 @@
+package backpressure
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+	"github.com/twmb/dash/wait"
+)
+
+func setup(t *testing.T, policy Policy) (*Queue, []int, *[]int) {
+	dropped := new([]int)
+	q := New(mpmcdvq.New(2), policy, func(ptr unsafe.Pointer) {
+		*dropped = append(*dropped, *(*int)(ptr))
+	})
+	vals := []int{0, 1, 2, 3}
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(unsafe.Pointer(&vals[i])); err != nil {
+			t.Fatalf("unexpected enqueue err: %v", err)
+		}
+	}
+	return q, vals, dropped
+}
+
+func expectDequeues(t *testing.T, q *Queue, exps ...int) {
+	for _, exp := range exps {
+		ptr, dequeued := q.TryDequeue()
+		if !dequeued || *(*int)(ptr) != exp {
+			t.Fatalf("expected dequeue of %d", exp)
+		}
+	}
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue from empty queue")
+	}
+}
+
+func TestFail(t *testing.T) {
+	q, vals, _ := setup(t, Fail)
+	if err := q.Enqueue(unsafe.Pointer(&vals[2])); err != ErrFull {
+		t.Fatalf("got err %v, expected ErrFull", err)
+	}
+	expectDequeues(t, q, 0, 1)
+	if s := q.Stats(); s.Enqueued != 2 || s.Failed != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	q, vals, dropped := setup(t, DropNewest)
+	q.Enqueue(unsafe.Pointer(&vals[2]))
+	expectDequeues(t, q, 0, 1)
+	if len(*dropped) != 1 || (*dropped)[0] != 2 {
+		t.Errorf("got dropped %v, expected [2]", *dropped)
+	}
+	if s := q.Stats(); s.Enqueued != 2 || s.DroppedNewest != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	q, vals, dropped = setup(t, DropOldest)
+	q.Enqueue(unsafe.Pointer(&vals[2]))
+	q.Enqueue(unsafe.Pointer(&vals[3]))
+	expectDequeues(t, q, 2, 3)
+	if len(*dropped) != 2 || (*dropped)[0] != 0 || (*dropped)[1] != 1 {
+		t.Errorf("got dropped %v, expected [0 1]", *dropped)
+	}
+	if s := q.Stats(); s.Enqueued != 4 || s.DroppedOldest != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	q, vals, _ := setup(t, Spill)
+	q.Enqueue(unsafe.Pointer(&vals[2]))
+	// Once spilling, we keep spilling even if there is room, to keep
+	// order.
+	ptr, _ := q.TryDequeue()
+	if *(*int)(ptr) != 0 {
+		t.Fatal("expected dequeue of 0")
+	}
+	q.Enqueue(unsafe.Pointer(&vals[3]))
+	expectDequeues(t, q, 1, 2, 3)
+	if s := q.Stats(); s.Enqueued != 4 || s.Spilled != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	q, vals, _ := setup(t, Block)
+	done := make(chan struct{})
+	go func() {
+		q.Enqueue(unsafe.Pointer(&vals[2]))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("unexpected enqueue into full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if *(*int)(q.Dequeue()) != 0 {
+		t.Fatal("expected dequeue of 0")
+	}
+	<-done
+	expectDequeues(t, q, 1, 2)
+	if s := q.Stats(); s.Enqueued != 3 || s.Blocked != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestBlockWait(t *testing.T) {
+	q := NewWait(mpmcdvq.New(2), Block, nil, wait.NewFutex(), wait.NewFutex())
+	vals := []int{0, 1, 2}
+	q.Enqueue(unsafe.Pointer(&vals[0]))
+	q.Enqueue(unsafe.Pointer(&vals[1]))
+	done := make(chan struct{})
+	go func() {
+		q.Enqueue(unsafe.Pointer(&vals[2]))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("unexpected enqueue into full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if *(*int)(q.Dequeue()) != 0 {
+		t.Fatal("expected dequeue of 0")
+	}
+	<-done
+	expectDequeues(t, q, 1, 2)
+}
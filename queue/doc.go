@@ -7,6 +7,27 @@
 // dequeue. This is done to eliminate the need of a heap allocated interface
 // that contains a pointer to the heap allocated variable you are enqueueing.
 //
+// This package defines the interfaces queues implement, and queuetest/
+// contains a conformance test suite that any TryQueue can be run against.
+// lincheck/ checks recorded histories of concurrent operations for
+// linearizability.
+//
 // {m,s}p{m,s}cdvq's contains a transliteration of Dmitry Vyukov's mpmc bounded queue,
 // www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue.
+//
+// spsclamport is a single-producer single-consumer ring that avoids touching
+// shared cache lines by caching the other side's index.
+//
+// mpmcshard relaxes FIFO ordering by sharding across multiple mpmcdvq's,
+// trading ordering for less contention.
+//
+// mpmcdelay is a delay queue, only returning values once they are due, and
+// mpmcprio is a bounded priority queue with strict or relaxed ordering. For a
+// handful of fixed priority classes, mpmclane dispatches across mpmcdvq lanes.
+//
+// backpressure wraps any of the bounded queues with a policy for handling a
+// full queue.
+//
+// persist is a durable, mmap-backed multi-producer single-consumer queue that
+// survives restarts.
 package queue
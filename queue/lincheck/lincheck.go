@@ -0,0 +1,219 @@
+// Package lincheck checks histories of concurrent queue operations for
+// linearizability against a sequential FIFO queue.
+//
+// A Recorder wraps a queue, recording when every TryEnqueue and TryDequeue is
+// invoked and when it returns. Check then searches for a linearization of the
+// recorded history: a total order of the operations that respects real time
+// (an operation that returned before another was invoked comes first) and
+// that a sequential bounded FIFO queue could have produced. The search is
+// Wing & Gong's, with Lowe's memoization of already explored states, as used
+// by Porcupine.
+//
+// The search is exponential in the worst case, so histories should be small:
+// a few goroutines each running a handful of operations, repeated many times.
+package lincheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/twmb/dash/queue"
+)
+
+// Kind is the kind of an operation.
+type Kind uint8
+
+const (
+	// Enqueue is a TryEnqueue.
+	Enqueue Kind = iota
+	// Dequeue is a TryDequeue.
+	Dequeue
+)
+
+// Op is one completed operation in a history.
+type Op struct {
+	Kind Kind
+	// Value is the value enqueued or dequeued.
+	Value unsafe.Pointer
+	// Ok is whether the operation succeeded.
+	Ok bool
+	// Call and Return are when the operation was invoked and when it
+	// returned.
+	Call   int64
+	Return int64
+}
+
+func (o Op) String() string {
+	kind := "enq"
+	if o.Kind == Dequeue {
+		kind = "deq"
+	}
+	return fmt.Sprintf("[%d,%d] %s(%p) %v", o.Call, o.Return, kind, o.Value, o.Ok)
+}
+
+// Recorder wraps a queue, recording a history of operations on it.
+//
+// Times are taken from a logical clock shared by all operations on the
+// recorder. The clock ticks when an operation is invoked and when it returns,
+// which orders operations the same as real time would.
+type Recorder struct {
+	q     queue.TryQueue
+	clock int64
+
+	mu  sync.Mutex
+	ops []Op
+}
+
+var _ queue.TryQueue = (*Recorder)(nil)
+
+// NewRecorder returns a Recorder wrapping q.
+func NewRecorder(q queue.TryQueue) *Recorder {
+	return &Recorder{q: q}
+}
+
+func (r *Recorder) record(op Op) {
+	r.mu.Lock()
+	r.ops = append(r.ops, op)
+	r.mu.Unlock()
+}
+
+// TryEnqueue calls TryEnqueue on the wrapped queue and records the call.
+func (r *Recorder) TryEnqueue(ptr unsafe.Pointer) bool {
+	call := atomic.AddInt64(&r.clock, 1)
+	enqueued := r.q.TryEnqueue(ptr)
+	ret := atomic.AddInt64(&r.clock, 1)
+	r.record(Op{Kind: Enqueue, Value: ptr, Ok: enqueued, Call: call, Return: ret})
+	return enqueued
+}
+
+// TryDequeue calls TryDequeue on the wrapped queue and records the call.
+func (r *Recorder) TryDequeue() (unsafe.Pointer, bool) {
+	call := atomic.AddInt64(&r.clock, 1)
+	ptr, dequeued := r.q.TryDequeue()
+	ret := atomic.AddInt64(&r.clock, 1)
+	r.record(Op{Kind: Dequeue, Value: ptr, Ok: dequeued, Call: call, Return: ret})
+	return ptr, dequeued
+}
+
+// History returns the operations recorded so far, ordered by when they were
+// invoked. Operations still running are not included.
+func (r *Recorder) History() []Op {
+	r.mu.Lock()
+	ops := append([]Op(nil), r.ops...)
+	r.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	return ops
+}
+
+// Model is the sequential specification histories are checked against: a
+// FIFO queue holding at most Capacity values.
+type Model struct {
+	Capacity int
+	// Strict requires failed operations to linearize, meaning a
+	// TryEnqueue may only fail while the queue is full, and a TryDequeue
+	// only while the queue is empty. Without Strict, operations may fail
+	// at any time, and failures are ignored. The dvq queues need this
+	// leniency: a dequeuer fails when the value at its position is not yet
+	// published, even if later values are.
+	Strict bool
+}
+
+// step applies op to the queue state q, returning the new state and whether
+// op was valid in q.
+func (m Model) step(q []uintptr, op *Op) ([]uintptr, bool) {
+	switch {
+	case op.Kind == Enqueue && op.Ok:
+		if len(q) == m.Capacity {
+			return nil, false
+		}
+		next := make([]uintptr, len(q)+1)
+		copy(next, q)
+		next[len(q)] = uintptr(op.Value)
+		return next, true
+	case op.Kind == Dequeue && op.Ok:
+		if len(q) == 0 || q[0] != uintptr(op.Value) {
+			return nil, false
+		}
+		return q[1:], true
+	case op.Kind == Enqueue:
+		return q, !m.Strict || len(q) == m.Capacity
+	default:
+		return q, !m.Strict || len(q) == 0
+	}
+}
+
+// checker holds the search state for Check.
+type checker struct {
+	m    Model
+	ops  []Op
+	done []bool
+	// seen holds explored (linearized set, queue state) pairs.
+	seen map[string]bool
+}
+
+func (c *checker) key(q []uintptr) string {
+	var b strings.Builder
+	for _, d := range c.done {
+		if d {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	}
+	for _, v := range q {
+		fmt.Fprintf(&b, ",%x", v)
+	}
+	return b.String()
+}
+
+// search tries to linearize every remaining operation starting from state q.
+func (c *checker) search(q []uintptr, left int) bool {
+	if left == 0 {
+		return true
+	}
+	k := c.key(q)
+	if c.seen[k] {
+		return false
+	}
+	c.seen[k] = true
+
+	// An operation can be linearized next only if it was invoked before
+	// every remaining operation returned.
+	minReturn := int64(-1)
+	for i := range c.ops {
+		if !c.done[i] && (minReturn < 0 || c.ops[i].Return < minReturn) {
+			minReturn = c.ops[i].Return
+		}
+	}
+	for i := range c.ops {
+		op := &c.ops[i]
+		if c.done[i] || op.Call > minReturn {
+			continue
+		}
+		next, ok := c.m.step(q, op)
+		if !ok {
+			continue
+		}
+		c.done[i] = true
+		if c.search(next, left-1) {
+			return true
+		}
+		c.done[i] = false
+	}
+	return false
+}
+
+// Check returns whether history is linearizable with respect to m.
+func Check(m Model, history []Op) bool {
+	c := &checker{
+		m:    m,
+		ops:  history,
+		done: make([]bool, len(history)),
+		seen: make(map[string]bool),
+	}
+	return c.search(nil, len(history))
+}
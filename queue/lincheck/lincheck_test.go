@@ -0,0 +1,108 @@
+package lincheck
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+)
+
+func TestCheck(t *testing.T) {
+	a, b := unsafe.Pointer(new(int)), unsafe.Pointer(new(int))
+	enq := func(v unsafe.Pointer, ok bool, call, ret int64) Op {
+		return Op{Kind: Enqueue, Value: v, Ok: ok, Call: call, Return: ret}
+	}
+	deq := func(v unsafe.Pointer, ok bool, call, ret int64) Op {
+		return Op{Kind: Dequeue, Value: v, Ok: ok, Call: call, Return: ret}
+	}
+
+	for _, test := range []struct {
+		name    string
+		m       Model
+		history []Op
+		want    bool
+	}{
+		{
+			name:    "sequential fifo",
+			m:       Model{Capacity: 2},
+			history: []Op{enq(a, true, 1, 2), enq(b, true, 3, 4), deq(a, true, 5, 6), deq(b, true, 7, 8)},
+			want:    true,
+		},
+		{
+			name:    "sequential lifo",
+			m:       Model{Capacity: 2},
+			history: []Op{enq(a, true, 1, 2), enq(b, true, 3, 4), deq(b, true, 5, 6), deq(a, true, 7, 8)},
+		},
+		{
+			name:    "overlapping enqueues in either order",
+			m:       Model{Capacity: 2},
+			history: []Op{enq(a, true, 1, 4), enq(b, true, 2, 3), deq(b, true, 5, 6), deq(a, true, 7, 8)},
+			want:    true,
+		},
+		{
+			name:    "dequeue overlapping its enqueue",
+			m:       Model{Capacity: 2},
+			history: []Op{enq(a, true, 1, 4), deq(a, true, 2, 3)},
+			want:    true,
+		},
+		{
+			name:    "dequeue before its enqueue",
+			m:       Model{Capacity: 2},
+			history: []Op{deq(a, true, 1, 2), enq(a, true, 3, 4)},
+		},
+		{
+			name:    "over capacity",
+			m:       Model{Capacity: 1},
+			history: []Op{enq(a, true, 1, 2), enq(b, true, 3, 4)},
+		},
+		{
+			name:    "spurious failed dequeue",
+			m:       Model{Capacity: 2},
+			history: []Op{enq(a, true, 1, 2), deq(nil, false, 3, 4), deq(a, true, 5, 6)},
+			want:    true,
+		},
+		{
+			name:    "strict failed dequeue",
+			m:       Model{Capacity: 2, Strict: true},
+			history: []Op{enq(a, true, 1, 2), deq(nil, false, 3, 4), deq(a, true, 5, 6)},
+		},
+		{
+			name:    "strict failed dequeue overlapping enqueue",
+			m:       Model{Capacity: 2, Strict: true},
+			history: []Op{enq(a, true, 1, 4), deq(nil, false, 2, 3), deq(a, true, 5, 6)},
+			want:    true,
+		},
+		{
+			name:    "strict failed enqueue",
+			m:       Model{Capacity: 2, Strict: true},
+			history: []Op{enq(a, true, 1, 2), enq(b, false, 3, 4)},
+		},
+		{
+			name:    "strict full enqueue",
+			m:       Model{Capacity: 1, Strict: true},
+			history: []Op{enq(a, true, 1, 2), enq(b, false, 3, 4)},
+			want:    true,
+		},
+	} {
+		if got := Check(test.m, test.history); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(mpmcdvq.New(2))
+	for i := 0; i < 3; i++ {
+		r.TryEnqueue(unsafe.Pointer(new(int)))
+	}
+	for i := 0; i < 3; i++ {
+		r.TryDequeue()
+	}
+	history := r.History()
+	if len(history) != 6 {
+		t.Fatalf("recorded %d ops, want 6", len(history))
+	}
+	if !Check(Model{Capacity: 2, Strict: true}, history) {
+		t.Errorf("sequential history not linearizable: %v", history)
+	}
+}
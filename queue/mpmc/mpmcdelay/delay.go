@@ -0,0 +1,228 @@
+// Package mpmcdelay provides a concurrent multi-producer multi-consumer delay
+// queue, where enqueued values only become visible to dequeuers once they are
+// due.
+//
+// Values are kept in a min-heap ordered by due time, with values due at the
+// same time dequeued in enqueue order. The heap is protected by a mutex; this
+// queue is meant for scheduling work in the future (retries, timeouts), not for
+// the throughput of the dvq queues.
+//
+// Dequeue waits on a wait.Strategy, by default a block.Block, until the
+// earliest value is due. Rather than every parked dequeuer sleeping on its own
+// timer, the queue keeps one timer armed for the earliest due time, and that
+// timer signals the strategy. Strategies that do not park ignore the signal and
+// simply poll until the value is due. Enqueueing
+// a value that is due earlier than every other value re-arms that timer and
+// wakes dequeuers so that they re-check.
+package mpmcdelay
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/wait"
+)
+
+// Timer is a stoppable pending function call, as returned from a Clock's
+// AfterFunc. *time.Timer implements Timer.
+type Timer interface {
+	Stop() bool
+}
+
+// Clock provides the current time and delayed function calls to a Queue. Tests
+// can provide their own Clock to control time deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// item is an enqueued value.
+type item struct {
+	at  time.Time
+	seq uint64
+	ptr unsafe.Pointer
+}
+
+func (i *item) less(j *item) bool {
+	if i.at.Equal(j.at) {
+		return i.seq < j.seq
+	}
+	return i.at.Before(j.at)
+}
+
+// Queue represents a multi-producer, multi-consumer delay queue.
+type Queue struct {
+	clock Clock
+	w     wait.Strategy
+
+	mu    sync.Mutex
+	items []item
+	seq   uint64
+	// timer, if non-nil, is armed to signal w at timerAt. timerGen
+	// identifies the armed timer so that a stale timer firing does not
+	// clear a newer one.
+	timer    Timer
+	timerAt  time.Time
+	timerGen uint64
+}
+
+// New returns a new Queue using the real clock.
+func New() *Queue {
+	return NewClock(realClock{})
+}
+
+// NewClock returns a new Queue that uses clock for all time keeping.
+func NewClock(clock Clock) *Queue {
+	return NewClockWait(clock, block.New())
+}
+
+// NewClockWait is NewClock, with Dequeue waiting with w rather than a block.
+func NewClockWait(clock Clock, w wait.Strategy) *Queue {
+	return &Queue{
+		clock: clock,
+		w:     w,
+	}
+}
+
+// Len returns the number of values in the queue, due or not.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	l := len(q.items)
+	q.mu.Unlock()
+	return l
+}
+
+// Enqueue adds a value to the queue that becomes visible to dequeuers at at.
+func (q *Queue) Enqueue(ptr unsafe.Pointer, at time.Time) {
+	q.mu.Lock()
+	q.items = append(q.items, item{at: at, seq: q.seq, ptr: ptr})
+	q.seq++
+	earliest := q.up(len(q.items)-1) == 0
+	if earliest {
+		q.arm()
+	}
+	q.mu.Unlock()
+	// If we are the new earliest value, dequeuers are waiting on a timer
+	// for a later value or on nothing at all; they must re-check.
+	if earliest {
+		q.w.Signal()
+	}
+}
+
+// TryDequeue dequeues the earliest value if it is due. If the queue is empty
+// or the earliest value is not yet due, this will return failure.
+func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	q.mu.Lock()
+	ptr, dequeued = q.tryDequeue()
+	more := dequeued && len(q.items) > 0 && !q.items[0].at.After(q.clock.Now())
+	q.mu.Unlock()
+	// If more values are due, other dequeuers may have been waiting on
+	// the value we just took; wake them to take the rest.
+	if more {
+		q.w.Signal()
+	}
+	return
+}
+
+// Dequeue dequeues the earliest value, blocking until it is due.
+func (q *Queue) Dequeue() unsafe.Pointer {
+	var deq unsafe.Pointer
+	q.w.Do(func() (dequeued bool) {
+		deq, dequeued = q.TryDequeue()
+		return
+	})
+	return deq
+}
+
+// tryDequeue pops the earliest value if it is due, otherwise ensuring the
+// timer is armed for it; mu must be held.
+func (q *Queue) tryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	if len(q.items) == 0 {
+		return
+	}
+	if q.items[0].at.After(q.clock.Now()) {
+		q.arm()
+		return
+	}
+	ptr = q.items[0].ptr
+	last := len(q.items) - 1
+	q.items[0] = q.items[last]
+	q.items[last] = item{}
+	q.items = q.items[:last]
+	q.down(0)
+	return ptr, true
+}
+
+// arm ensures the timer is armed for the earliest value if it is not yet due;
+// mu must be held.
+func (q *Queue) arm() {
+	at := q.items[0].at
+	d := at.Sub(q.clock.Now())
+	if d <= 0 {
+		return
+	}
+	if q.timer != nil {
+		if !q.timerAt.After(at) {
+			return
+		}
+		q.timer.Stop()
+	}
+	q.timerGen++
+	gen := q.timerGen
+	q.timerAt = at
+	q.timer = q.clock.AfterFunc(d, func() { q.fire(gen) })
+}
+
+// fire wakes dequeuers once the earliest value is due.
+func (q *Queue) fire(gen uint64) {
+	q.mu.Lock()
+	if q.timerGen == gen {
+		q.timer = nil
+	}
+	q.mu.Unlock()
+	q.w.Signal()
+}
+
+// up and down are container/heap's up and down, specialized to our items. up
+// returns the final index of the item.
+
+func (q *Queue) up(j int) int {
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !q.items[j].less(&q.items[i]) {
+			break
+		}
+		q.items[i], q.items[j] = q.items[j], q.items[i]
+		j = i
+	}
+	return j
+}
+
+func (q *Queue) down(i int) {
+	n := len(q.items)
+	for {
+		j1 := 2*i + 1
+		if j1 >= n || j1 < 0 { // j1 < 0 after int overflow
+			break
+		}
+		j := j1 // left child
+		if j2 := j1 + 1; j2 < n && q.items[j2].less(&q.items[j1]) {
+			j = j2 // = 2*i + 2  // right child
+		}
+		if !q.items[j].less(&q.items[i]) {
+			break
+		}
+		q.items[i], q.items[j] = q.items[j], q.items[i]
+		i = j
+	}
+}
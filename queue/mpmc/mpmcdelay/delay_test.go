@@ -0,0 +1,164 @@
+package mpmcdelay
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/wait"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c       *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	was := !t.stopped
+	t.stopped = true
+	return was
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var fire []func()
+	keep := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.stopped = true
+			fire = append(fire, t.f)
+		default:
+			keep = append(keep, t)
+		}
+	}
+	c.timers = keep
+	c.mu.Unlock()
+	for _, f := range fire {
+		go f()
+	}
+}
+
+func TestTryDequeue(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	q := NewClock(c)
+	vals := []int{0, 1, 2, 3}
+	q.Enqueue(unsafe.Pointer(&vals[2]), c.now.Add(2*time.Second))
+	q.Enqueue(unsafe.Pointer(&vals[0]), c.now.Add(time.Second))
+	q.Enqueue(unsafe.Pointer(&vals[3]), c.now.Add(2*time.Second))
+	q.Enqueue(unsafe.Pointer(&vals[1]), c.now.Add(time.Second))
+
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue before anything is due")
+	}
+	c.Advance(time.Second)
+	for _, exp := range []int{0, 1} {
+		ptr, dequeued := q.TryDequeue()
+		if !dequeued || *(*int)(ptr) != exp {
+			t.Fatalf("expected due dequeue of %d", exp)
+		}
+	}
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue of value not yet due")
+	}
+	c.Advance(time.Second)
+	for _, exp := range []int{2, 3} {
+		ptr, dequeued := q.TryDequeue()
+		if !dequeued || *(*int)(ptr) != exp {
+			t.Fatalf("expected due dequeue of %d", exp)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("got len %d, expected 0", q.Len())
+	}
+}
+
+func TestDequeueWaits(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	q := NewClock(c)
+	vals := []int{0, 1}
+
+	got := make(chan int)
+	for range vals {
+		go func() { got <- *(*int)(q.Dequeue()) }()
+	}
+	expectNone := func() {
+		select {
+		case v := <-got:
+			t.Fatalf("unexpected dequeue of %d", v)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	expect := func(exp int) {
+		select {
+		case v := <-got:
+			if v != exp {
+				t.Fatalf("got dequeue of %d, expected %d", v, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected dequeue of %d", exp)
+		}
+	}
+
+	q.Enqueue(unsafe.Pointer(&vals[1]), c.now.Add(2*time.Second))
+	expectNone()
+	// An earlier value must re-arm the wakeup for the waiting dequeuers.
+	q.Enqueue(unsafe.Pointer(&vals[0]), c.now.Add(time.Second))
+	expectNone()
+	c.Advance(time.Second)
+	expect(0)
+	expectNone()
+	c.Advance(time.Second)
+	expect(1)
+}
+
+// TestDequeuePolls checks that a strategy ignoring the timer's signal still
+// dequeues once the value is due.
+func TestDequeuePolls(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	q := NewClockWait(c, wait.Yield{})
+	v := 1
+	q.Enqueue(unsafe.Pointer(&v), c.now.Add(time.Second))
+
+	got := make(chan int)
+	go func() { got <- *(*int)(q.Dequeue()) }()
+	select {
+	case v := <-got:
+		t.Fatalf("unexpected dequeue of %d before it is due", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("expected dequeue once due")
+	}
+}
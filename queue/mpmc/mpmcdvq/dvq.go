@@ -5,18 +5,25 @@ import (
 	"unsafe"
 
 	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue"
 )
 
+var _ queue.BatchQueue = (*Queue)(nil)
+
 // TryEnqueue adds a value to our queue. TryEnqueue takes an unsafe.Pointer to
 // avoid the necessity of wrapping a heap allocated value in an interface,
 // which also goes on the heap. If the queue is full, this will return failure.
 func (q *Queue) TryEnqueue(ptr unsafe.Pointer) (enqueued bool) {
+	if primitive.Debug {
+		q.enter()
+		defer q.exit()
+	}
 	var c *cell
 	// Race load our enqPos,
 	pos := atomic.LoadUintptr(&q.enqPos)
 	for {
 		// load the cell at that enqPos,
-		c = &q.cells[pos&q.mask]
+		c = q.cell(pos)
 		// load the sequence number in that cell,
 		seq := atomic.LoadUintptr(&c.seq)
 		// and, if the sequence number is (enqPos), we have a spot to
@@ -52,12 +59,16 @@ func (q *Queue) TryEnqueue(ptr unsafe.Pointer) (enqueued bool) {
 // TryDequeue dequeues a value from our queue. If the queue is empty, this
 // will return failure.
 func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	if primitive.Debug {
+		q.enter()
+		defer q.exit()
+	}
 	var c *cell
 	// Race load our deqPos,
 	pos := atomic.LoadUintptr(&q.deqPos)
 	for {
 		// load the cell at that deqPos,
-		c = &q.cells[pos&q.mask]
+		c = q.cell(pos)
 		// load the sequence number in that cell,
 		seq := atomic.LoadUintptr(&c.seq)
 		// and, if the sequence number is (deqPos + 1), we have an
@@ -90,3 +101,27 @@ func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
 	atomic.StoreUintptr(&c.seq, pos+q.mask)
 	return
 }
+
+// TryEnqueueBatch enqueues values from the front of ptrs until the queue is
+// full, returning the number of values enqueued.
+func (q *Queue) TryEnqueueBatch(ptrs []unsafe.Pointer) int {
+	for i, ptr := range ptrs {
+		if !q.TryEnqueue(ptr) {
+			return i
+		}
+	}
+	return len(ptrs)
+}
+
+// TryDequeueBatch dequeues values into ptrs until ptrs is full or the queue is
+// empty, returning the number of values dequeued.
+func (q *Queue) TryDequeueBatch(ptrs []unsafe.Pointer) int {
+	for i := range ptrs {
+		ptr, dequeued := q.TryDequeue()
+		if !dequeued {
+			return i
+		}
+		ptrs[i] = ptr
+	}
+	return len(ptrs)
+}
@@ -0,0 +1,34 @@
+//go:build dashdebug
+// +build dashdebug
+
+package mpmcdvq
+
+import "testing"
+
+func expectPanic(t *testing.T, what string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic: %s", what)
+		}
+	}()
+	fn()
+}
+
+// TestResetMisuse checks that debug builds catch Reset racing operations,
+// from either side.
+func TestResetMisuse(t *testing.T) {
+	q := New(4)
+	q.enter() // an operation in flight
+	expectPanic(t, "Reset during an operation", q.Reset)
+	q.exit()
+	q.Reset()
+	if !q.TryEnqueue(nil) {
+		t.Fatal("unable to enqueue after Reset")
+	}
+
+	q.inflight = resetting // a Reset in progress
+	expectPanic(t, "enqueue during Reset", func() { q.TryEnqueue(nil) })
+	q.inflight = resetting
+	expectPanic(t, "dequeue during Reset", func() { q.TryDequeue() })
+}
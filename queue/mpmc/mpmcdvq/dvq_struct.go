@@ -15,13 +15,12 @@
 package mpmcdvq
 
 import (
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/twmb/dash/primitive"
 )
 
-const cellSz = unsafe.Sizeof(cell{})
-
 // cell is an individual spot in our queue.
 type cell struct {
 	// seq is a number that has a base value of its position in the queue.
@@ -42,20 +41,48 @@ type cell struct {
 	seq uintptr
 	// ptr is set to what we enqueue, and null when we dequeue.
 	ptr unsafe.Pointer
+}
+
+// paddedCell is a cell in the default layout.
+type paddedCell struct {
+	cell
 	// we pad between cells so that dequeues do not share with enqueues.
 	_pad [primitive.FalseShare - primitive.UpSz]byte
 }
 
+const (
+	paddedCellSz = unsafe.Sizeof(paddedCell{})
+	cellSz       = unsafe.Sizeof(cell{})
+	// lineCells is the number of compact cells in a false sharing range.
+	lineCells = primitive.FalseShare / cellSz
+)
+
 // Queue represents a multi-producer, multi-consumer, fast queue.
 type Queue struct {
-	// padding to ensure mask/bufPtr are not on a write modified cache
-	// line when trying to read mask/bufPtr.
+	// padding to ensure our read only fields are not on a write modified
+	// cache line when trying to read them.
 	_pad0 [primitive.FalseShare - primitive.UpSz]byte
 	// mask is the size of our queue - 1. Because the size of the queue is
 	// forced to be a power of 2, we index into slots via masking.
-	mask  uintptr
-	cells []cell
-	_pad1 [primitive.FalseShare - primitive.UpSz]byte
+	mask uintptr
+	// cells points to the first cell, with each cell stride bytes apart.
+	cells  unsafe.Pointer
+	stride uintptr
+	// ncells is the number of cells allocated, which may be more than
+	// the queue uses if the queue was reused.
+	ncells uintptr
+	// Positions are remapped to cell indices as
+	//
+	//     (pos & lineMask) << lineShift | (pos >> lineShift2) & cellMask
+	//
+	// For the padded layout, this is pos & mask. For the compact layout,
+	// consecutive positions land in consecutive false sharing ranges,
+	// wrapping around to the next cell in each range.
+	lineMask   uintptr
+	lineShift  uintptr
+	lineShift2 uintptr
+	cellMask   uintptr
+	_pad1      [primitive.FalseShare - primitive.UpSz]byte
 	// padding enqPos to not share cache lines, enqPos tracks the current
 	// enqueueing position.
 	enqPos uintptr
@@ -63,21 +90,152 @@ type Queue struct {
 	// padding deqPos to not share cache lines, deqPos tracks the current
 	// dequeueing position.
 	deqPos uintptr
+	_pad3  [primitive.FalseShare - primitive.UpSz]byte
+	// inflight counts in flight operations when built with the dashdebug
+	// tag, allowing Reset to detect misuse.
+	inflight int32
 	// pad at the end to not share this queue with the next variable.
-	_pad3 [primitive.FalseShare - primitive.UpSz]byte
+	_pad4 [primitive.FalseShare - primitive.UpSz]byte
+}
+
+// roundSize returns size rounded up to the next power of 2, and to at least 2.
+// A queue with a single cell cannot tell full from empty: after an enqueue,
+// the cell's seq is what the next lap's enqueuer expects of an empty cell.
+func roundSize(size uint) uintptr {
+	if size < 2 {
+		return 2
+	}
+	return primitive.Next2(uintptr(size))
 }
 
-// New returns a new Queue, with size rounded up to the next power of 2.
+// New returns a new Queue, with size rounded up to the next power of 2, and
+// to at least 2.
+//
+// Each cell in the queue is padded to avoid false sharing, meaning each cell
+// uses over primitive.FalseShare bytes. For large queues, NewCompact may be
+// preferable.
 func New(size uint) *Queue {
-	size2 := primitive.Next2(uintptr(size))
-	cells := make([]cell, size2+1) // pad one cell at the start to avoid sharing it
-	for i := uintptr(0); i < size2+1; i++ {
-		cells[i].seq = i - 1 // remove the pad cell from the sequence number
+	size2 := roundSize(size)
+	cells := make([]paddedCell, size2+1) // pad one cell at the start to avoid sharing it
+
+	q := &Queue{
+		cells:  unsafe.Pointer(&cells[1]),
+		stride: paddedCellSz,
+		ncells: size2,
 	}
+	q.setSize(size2)
+	return q
+}
+
+// NewCompact returns a new Queue, with size rounded up to the next power of 2,
+// that packs multiple cells into each false sharing range.
+//
+// Rather than padding every cell, consecutive positions in the queue are
+// spread across different false sharing ranges. Enqueuers and dequeuers
+// working on nearby positions still touch different cache lines, so long as
+// they are fewer than size/(primitive.FalseShare/16) positions apart. This
+// keeps most of the benefit of padding while using a fraction of the memory.
+func NewCompact(size uint) *Queue {
+	size2 := roundSize(size)
+	// Pad a false sharing range on either side to avoid sharing with
+	// other allocations.
+	cells := make([]cell, size2+2*lineCells)
 
 	q := &Queue{
-		mask:  size2 - 1,
-		cells: cells[1:],
+		cells:  unsafe.Pointer(&cells[lineCells]),
+		stride: cellSz,
+		ncells: size2,
+	}
+	q.setSize(size2)
+	return q
+}
+
+// Reuse returns a Queue with size rounded up to the next power of 2, reusing q
+// and its cells if q is non-nil and has at least that many cells. Otherwise,
+// Reuse allocates a new Queue with the same layout as q. Any values left in q
+// are discarded.
+//
+// q must not be in use; Reuse is meant for recycling queues through a
+// sync.Pool:
+//
+//	q, _ := pool.Get().(*mpmcdvq.Queue)
+//	q = mpmcdvq.Reuse(q, size)
+//	...
+//	pool.Put(q)
+func Reuse(q *Queue, size uint) *Queue {
+	size2 := roundSize(size)
+	switch {
+	case q == nil:
+		return New(size)
+	case q.ncells < size2 && q.stride == cellSz:
+		return NewCompact(size)
+	case q.ncells < size2:
+		return New(size)
 	}
+	q.setSize(size2)
 	return q
 }
+
+// setSize sets the queue to use its first size2 cells and resets it.
+func (q *Queue) setSize(size2 uintptr) {
+	q.mask = size2 - 1
+	q.lineMask = size2 - 1
+	q.lineShift, q.lineShift2, q.cellMask = 0, 0, 0
+	if q.stride == cellSz {
+		if lines := size2 / lineCells; lines > 1 {
+			for 1<<q.lineShift2 < lines {
+				q.lineShift2++
+			}
+			for 1<<q.lineShift < lineCells {
+				q.lineShift++
+			}
+			q.lineMask = lines - 1
+			q.cellMask = lineCells - 1
+		}
+	}
+	q.Reset()
+}
+
+// Reset empties the queue, discarding any values left in it, and restores it
+// to how it was when created. Reset must only be called while the queue is
+// quiescent: no enqueue or dequeue may run concurrently with Reset. When built
+// with the dashdebug tag, Reset and the operations racing it panic if they
+// detect misuse.
+func (q *Queue) Reset() {
+	if primitive.Debug && !atomic.CompareAndSwapInt32(&q.inflight, 0, resetting) {
+		panic("mpmcdvq: Reset while the queue is in use")
+	}
+	// Clear every allocated cell so that a shrunk queue does not keep
+	// values alive past its size.
+	for idx := uintptr(0); idx < q.ncells; idx++ {
+		(*cell)(unsafe.Pointer(uintptr(q.cells) + idx*q.stride)).ptr = primitive.Null
+	}
+	for pos := uintptr(0); pos <= q.mask; pos++ {
+		q.cell(pos).seq = pos
+	}
+	q.enqPos, q.deqPos = 0, 0
+	if primitive.Debug {
+		atomic.StoreInt32(&q.inflight, 0)
+	}
+}
+
+// resetting is stored in inflight while Reset runs, making concurrent
+// operations see a negative count.
+const resetting = -1 << 30
+
+// enter and exit track in flight operations in debug builds.
+func (q *Queue) enter() {
+	if atomic.AddInt32(&q.inflight, 1) < 0 {
+		panic("mpmcdvq: operation concurrent with Reset")
+	}
+}
+
+func (q *Queue) exit() {
+	atomic.AddInt32(&q.inflight, -1)
+}
+
+// cell returns the cell for a position.
+func (q *Queue) cell(pos uintptr) *cell {
+	idx := (pos&q.lineMask)<<q.lineShift | (pos>>q.lineShift2)&q.cellMask
+	return (*cell)(unsafe.Pointer(uintptr(q.cells) + idx*q.stride))
+}
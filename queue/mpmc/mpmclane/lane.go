@@ -0,0 +1,166 @@
+// Package mpmclane provides a multi-producer multi-consumer dispatcher over a
+// fixed number of priority lanes, each lane being an mpmcdvq.
+//
+// Lane 0 is the highest priority lane. Producers enqueue into a specific lane,
+// while consumers dequeue from the dispatcher as a whole, with the dispatcher
+// choosing which lane to take from. All lanes share one wait strategy for
+// dequeuers, meaning a dequeuer waits for work on any lane, rather than on one
+// lane.
+//
+// A Strict dispatcher always takes from the highest priority non-empty lane.
+// Lower lanes can starve if higher lanes are never empty.
+//
+// A Weighted dispatcher prevents starvation. Each lane has a weight, and out of
+// every sum(weights) dequeues, lane i is preferred weights[i] times. The
+// preferred lanes are interleaved (using nginx's smooth weighted round robin),
+// rather than bursty. If the preferred lane is empty, the dispatcher falls
+// back to taking from the highest priority non-empty lane, meaning the
+// weights are only a floor on each lane's share when all lanes are busy.
+package mpmclane
+
+import (
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+	"github.com/twmb/dash/wait"
+)
+
+// Dispatcher represents a multi-producer, multi-consumer set of priority
+// lanes.
+type Dispatcher struct {
+	_pad0 [primitive.FalseShare - primitive.UpSz]byte
+	lanes []*mpmcdvq.Queue
+	// schedule, if non-nil, is the weighted order of preferred lanes.
+	schedule []int
+	enqW     wait.Strategy
+	deqW     wait.Strategy
+	_pad1    [primitive.FalseShare - primitive.UpSz]byte
+	// ticket indexes into schedule.
+	ticket uintptr
+	_pad2  [primitive.FalseShare - primitive.UpSz]byte
+}
+
+// NewStrict returns a Dispatcher with the given number of lanes, each of the
+// given size rounded up to the next power of 2, that always dequeues from the
+// highest priority non-empty lane.
+func NewStrict(lanes int, size uint) *Dispatcher {
+	return NewStrictWait(lanes, size, block.New(), block.New())
+}
+
+// NewStrictWait is NewStrict, waiting with the given strategies rather than
+// blocks: enq while Enqueue waits for room in its lane, and deq while Dequeue
+// waits for a value in any lane.
+func NewStrictWait(lanes int, size uint, enq, deq wait.Strategy) *Dispatcher {
+	if lanes < 1 {
+		panic("mpmclane: lanes must be at least one")
+	}
+	d := &Dispatcher{
+		lanes: make([]*mpmcdvq.Queue, 0, lanes),
+		enqW:  enq,
+		deqW:  deq,
+	}
+	for i := 0; i < lanes; i++ {
+		d.lanes = append(d.lanes, mpmcdvq.New(size))
+	}
+	return d
+}
+
+// NewWeighted returns a Dispatcher with one lane per weight, each of the given
+// size rounded up to the next power of 2, that prefers lanes according to
+// their weights. Every weight must be at least one.
+func NewWeighted(size uint, weights ...int) *Dispatcher {
+	return NewWeightedWait(size, block.New(), block.New(), weights...)
+}
+
+// NewWeightedWait is NewWeighted, waiting with the given strategies rather
+// than blocks, as in NewStrictWait.
+func NewWeightedWait(size uint, enq, deq wait.Strategy, weights ...int) *Dispatcher {
+	d := NewStrictWait(len(weights), size, enq, deq)
+
+	// Smooth weighted round robin: every step, each lane gains its
+	// weight, the lane with the most is picked, and that lane pays back
+	// the total.
+	var total int
+	for _, w := range weights {
+		if w < 1 {
+			panic("mpmclane: weights must be at least one")
+		}
+		total += w
+	}
+	current := make([]int, len(weights))
+	d.schedule = make([]int, 0, total)
+	for i := 0; i < total; i++ {
+		best := 0
+		for lane, w := range weights {
+			current[lane] += w
+			if current[lane] > current[best] {
+				best = lane
+			}
+		}
+		current[best] -= total
+		d.schedule = append(d.schedule, best)
+	}
+	return d
+}
+
+// Lanes returns the number of lanes in the dispatcher.
+func (d *Dispatcher) Lanes() int {
+	return len(d.lanes)
+}
+
+// TryEnqueue adds a value to the given lane. If that lane is full, this will
+// return failure.
+func (d *Dispatcher) TryEnqueue(lane int, ptr unsafe.Pointer) bool {
+	if d.lanes[lane].TryEnqueue(ptr) {
+		d.deqW.Signal()
+		return true
+	}
+	return false
+}
+
+// TryDequeue dequeues a value from the lane chosen by the dispatcher's policy.
+// If every lane is empty, this will return failure.
+func (d *Dispatcher) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	if d.schedule != nil {
+		// We only take our ticket once we dequeue, so that failed
+		// attempts (such as by Dequeue retrying after a spurious
+		// wakeup) do not skip lanes in the schedule. Concurrent
+		// dequeuers may share a ticket's preferred lane, but every
+		// dequeue still advances the schedule once.
+		ticket := primitive.LoadUintptr(&d.ticket)
+		preferred := d.schedule[ticket%uintptr(len(d.schedule))]
+		if ptr, dequeued = d.lanes[preferred].TryDequeue(); dequeued {
+			primitive.AddUintptr(&d.ticket, 1)
+			d.enqW.Signal()
+			return
+		}
+	}
+	for _, lane := range d.lanes {
+		if ptr, dequeued = lane.TryDequeue(); dequeued {
+			if d.schedule != nil {
+				primitive.AddUintptr(&d.ticket, 1)
+			}
+			d.enqW.Signal()
+			return
+		}
+	}
+	return
+}
+
+// Enqueue adds a value to the given lane, blocking while that lane is full.
+func (d *Dispatcher) Enqueue(lane int, ptr unsafe.Pointer) {
+	d.enqW.Do(func() bool { return d.TryEnqueue(lane, ptr) })
+}
+
+// Dequeue dequeues a value from the lane chosen by the dispatcher's policy,
+// blocking while every lane is empty.
+func (d *Dispatcher) Dequeue() unsafe.Pointer {
+	var deq unsafe.Pointer
+	d.deqW.Do(func() (dequeued bool) {
+		deq, dequeued = d.TryDequeue()
+		return
+	})
+	return deq
+}
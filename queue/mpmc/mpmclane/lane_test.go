@@ -0,0 +1,108 @@
+package mpmclane
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/wait"
+)
+
+func fill(t *testing.T, d *Dispatcher, perLane int) []int {
+	lanes := make([]int, d.Lanes())
+	for lane := range lanes {
+		lanes[lane] = lane
+		for i := 0; i < perLane; i++ {
+			if !d.TryEnqueue(lane, unsafe.Pointer(&lanes[lane])) {
+				t.Fatalf("unexpected failed enqueue into lane %d", lane)
+			}
+		}
+	}
+	return lanes
+}
+
+func TestStrict(t *testing.T) {
+	d := NewStrict(3, 4)
+	fill(t, d, 4)
+	if d.TryEnqueue(1, nil) {
+		t.Fatal("unexpected enqueue into full lane")
+	}
+	for i := 0; i < 12; i++ {
+		if got, exp := *(*int)(d.Dequeue()), i/4; got != exp {
+			t.Fatalf("dequeue %d: got lane %d, expected %d", i, got, exp)
+		}
+	}
+	if _, dequeued := d.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue from empty dispatcher")
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	d := NewWeighted(16, 3, 2, 1)
+	fill(t, d, 16)
+	// While every lane is busy, each round of six dequeues follows the
+	// weights, interleaved.
+	counts := make([]int, 3)
+	for i := 0; i < 12; i++ {
+		counts[*(*int)(d.Dequeue())]++
+	}
+	if counts[0] != 6 || counts[1] != 4 || counts[2] != 2 {
+		t.Fatalf("got lane counts %v, expected [6 4 2]", counts)
+	}
+	// Once higher lanes drain, lower lanes take the remainder.
+	for i := 12; i < 48; i++ {
+		counts[*(*int)(d.Dequeue())]++
+	}
+	if counts[0] != 16 || counts[1] != 16 || counts[2] != 16 {
+		t.Fatalf("got lane counts %v, expected [16 16 16]", counts)
+	}
+}
+
+// TestWeightedFailedDequeues checks that dequeues from an empty dispatcher do
+// not advance the schedule.
+func TestWeightedFailedDequeues(t *testing.T) {
+	d := NewWeighted(4, 1, 2) // schedule: 1, 0, 1
+	for i := 0; i < 4; i++ {
+		if _, dequeued := d.TryDequeue(); dequeued {
+			t.Fatal("unexpected dequeue from empty dispatcher")
+		}
+	}
+	fill(t, d, 4)
+	for i, exp := range []int{1, 0, 1, 1, 0, 1} {
+		if got := *(*int)(d.Dequeue()); got != exp {
+			t.Fatalf("dequeue %d: got lane %d, expected %d", i, got, exp)
+		}
+	}
+}
+
+func TestStrictWait(t *testing.T) {
+	d := NewStrictWait(2, 2, wait.NewFutex(), wait.NewFutex())
+	got := make(chan int)
+	go func() { got <- *(*int)(d.Dequeue()) }()
+	select {
+	case v := <-got:
+		t.Fatalf("unexpected dequeue of %d from empty dispatcher", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	lanes := fill(t, d, 2)
+	if v := <-got; v != 0 {
+		t.Fatalf("got dequeue from lane %d, expected 0", v)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.Enqueue(1, unsafe.Pointer(&lanes[1]))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("unexpected enqueue into full lane")
+	case <-time.After(10 * time.Millisecond):
+	}
+	for _, exp := range []int{0, 1} {
+		if v := *(*int)(d.Dequeue()); v != exp {
+			t.Fatalf("got dequeue from lane %d, expected %d", v, exp)
+		}
+	}
+	<-done
+}
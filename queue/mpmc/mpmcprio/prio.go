@@ -0,0 +1,234 @@
+// Package mpmcprio provides a concurrent, bounded, multi-producer
+// multi-consumer priority queue.
+//
+// A Queue runs in one of two modes. In Strict mode, the queue is a single
+// lock protected heap, and DeleteMin always returns the value with the
+// lowest priority number in the queue. Every operation contends on the one
+// lock.
+//
+// In Relaxed mode, the queue is a MultiQueue, as described in Rihani, Sanders
+// and Dementiev's "MultiQueues: Simpler, Faster, and Better Relaxed Concurrent
+// Priority Queues". The queue is split into multiple lock protected heaps.
+// Inserts go to a random heap, while deletes look at the tops of two random
+// heaps and take from the better one. Deletes are not guaranteed to return
+// the lowest value in the queue, but the expected rank of a returned value is
+// O(number of heaps), and contention is spread across all heaps.
+//
+// Values are ordered by a uint64 priority, with lower numbers dequeued
+// first. The queue is bounded; when the heap(s) an insert tries are full,
+// TryInsert fails and Insert blocks.
+package mpmcprio
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/wait"
+)
+
+// Mode is the ordering mode of a Queue.
+type Mode int
+
+const (
+	// Strict queues always dequeue the lowest priority value.
+	Strict Mode = iota
+	// Relaxed queues dequeue a value close to the lowest priority value,
+	// trading exact ordering for scalability.
+	Relaxed
+)
+
+// empty is the top of a heap with nothing in it. Values inserted with this
+// priority are still dequeued, but are considered last when choosing heaps.
+const empty = math.MaxUint64
+
+type entry struct {
+	prio uint64
+	ptr  unsafe.Pointer
+}
+
+// heap is one lock protected binary heap.
+type heap struct {
+	mu sync.Mutex
+	// top caches the priority of the top of the heap so that deleters
+	// can choose between heaps without locking.
+	top     uint64
+	entries []entry
+}
+
+// paddedHeap pads heaps to whole false sharing ranges, so that inserts and
+// deletes on one heap do not contend with those on its neighbors. A heap that
+// is already a multiple of the range is not padded.
+type paddedHeap struct {
+	heap
+	_pad [(primitive.FalseShare - unsafe.Sizeof(heap{})%primitive.FalseShare) % primitive.FalseShare]byte
+}
+
+func (h *heap) push(e entry) {
+	h.entries = append(h.entries, e)
+	j := len(h.entries) - 1
+	for j > 0 {
+		i := (j - 1) / 2 // parent
+		if h.entries[i].prio <= h.entries[j].prio {
+			break
+		}
+		h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+		j = i
+	}
+	atomic.StoreUint64(&h.top, h.entries[0].prio)
+}
+
+func (h *heap) pop() unsafe.Pointer {
+	ptr := h.entries[0].ptr
+	last := len(h.entries) - 1
+	h.entries[0] = h.entries[last]
+	h.entries[last] = entry{}
+	h.entries = h.entries[:last]
+	for i := 0; ; {
+		j := 2*i + 1 // left child
+		if j >= last {
+			break
+		}
+		if j2 := j + 1; j2 < last && h.entries[j2].prio < h.entries[j].prio {
+			j = j2 // right child
+		}
+		if h.entries[i].prio <= h.entries[j].prio {
+			break
+		}
+		h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+		i = j
+	}
+	if last == 0 {
+		atomic.StoreUint64(&h.top, empty)
+	} else {
+		atomic.StoreUint64(&h.top, h.entries[0].prio)
+	}
+	return ptr
+}
+
+// Queue represents a multi-producer, multi-consumer, bounded priority queue.
+type Queue struct {
+	_pad0 [primitive.FalseShare - primitive.UpSz]byte
+	// mask is the number of heaps - 1; the number of heaps is a power
+	// of 2.
+	mask     uintptr
+	heapSize int
+	heaps    []paddedHeap
+	insW     wait.Strategy
+	delW     wait.Strategy
+	_pad1    [primitive.FalseShare - primitive.UpSz]byte
+}
+
+// New returns a new Queue holding at least size values. Relaxed queues use
+// two heaps per GOMAXPROCS, splitting size across the heaps.
+func New(size uint, mode Mode) *Queue {
+	return NewWait(size, mode, block.New(), block.New())
+}
+
+// NewWait is New, waiting with the given strategies rather than blocks: ins
+// while Insert waits for room, and del while DeleteMin waits for a value.
+func NewWait(size uint, mode Mode, ins, del wait.Strategy) *Queue {
+	nheaps := uintptr(1)
+	if mode == Relaxed {
+		nheaps = primitive.Next2(uintptr(2 * runtime.GOMAXPROCS(0)))
+	}
+	heapSize := (uintptr(size) + nheaps - 1) / nheaps
+	if heapSize == 0 {
+		heapSize = 1
+	}
+	q := &Queue{
+		mask:     nheaps - 1,
+		heapSize: int(heapSize),
+		heaps:    make([]paddedHeap, nheaps),
+		insW:     ins,
+		delW:     del,
+	}
+	for i := range q.heaps {
+		q.heaps[i].top = empty
+		q.heaps[i].entries = make([]entry, 0, heapSize)
+	}
+	return q
+}
+
+// TryInsert adds a value to our queue with the given priority, where lower
+// priorities are dequeued first. If the queue is full, this will return
+// failure.
+func (q *Queue) TryInsert(prio uint64, ptr unsafe.Pointer) bool {
+	start := uintptr(0)
+	if q.mask > 0 {
+		start = uintptr(rand.Uint32())
+	}
+	for i := uintptr(0); i <= q.mask; i++ {
+		h := &q.heaps[(start+i)&q.mask].heap
+		h.mu.Lock()
+		if len(h.entries) < q.heapSize {
+			h.push(entry{prio, ptr})
+			h.mu.Unlock()
+			q.delW.Signal()
+			return true
+		}
+		h.mu.Unlock()
+	}
+	return false
+}
+
+// TryDeleteMin removes the value with the lowest priority from our queue (or,
+// for relaxed queues, a value close to the lowest). If the queue is empty,
+// this will return failure.
+func (q *Queue) TryDeleteMin() (ptr unsafe.Pointer, deleted bool) {
+	if q.mask > 0 {
+		// Try the better of two random heaps twice before
+		// falling back to scanning everything.
+		for tries := 0; tries < 2; tries++ {
+			r := rand.Uint64()
+			h1, h2 := &q.heaps[uintptr(r)&q.mask].heap, &q.heaps[uintptr(r>>32)&q.mask].heap
+			if atomic.LoadUint64(&h2.top) < atomic.LoadUint64(&h1.top) {
+				h1 = h2
+			}
+			if ptr, deleted = q.tryPop(h1); deleted {
+				return
+			}
+		}
+	}
+	for i := range q.heaps {
+		if ptr, deleted = q.tryPop(&q.heaps[i].heap); deleted {
+			return
+		}
+	}
+	return
+}
+
+func (q *Queue) tryPop(h *heap) (ptr unsafe.Pointer, popped bool) {
+	h.mu.Lock()
+	if len(h.entries) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	ptr = h.pop()
+	h.mu.Unlock()
+	q.insW.Signal()
+	return ptr, true
+}
+
+// Insert adds a value to our queue with the given priority, blocking while the
+// queue is full.
+func (q *Queue) Insert(prio uint64, ptr unsafe.Pointer) {
+	q.insW.Do(func() bool { return q.TryInsert(prio, ptr) })
+}
+
+// DeleteMin removes the value with the lowest priority from our queue (or,
+// for relaxed queues, a value close to the lowest), blocking while the queue is
+// empty.
+func (q *Queue) DeleteMin() unsafe.Pointer {
+	var ptr unsafe.Pointer
+	q.delW.Do(func() (deleted bool) {
+		ptr, deleted = q.TryDeleteMin()
+		return
+	})
+	return ptr
+}
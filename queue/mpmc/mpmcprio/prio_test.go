@@ -0,0 +1,166 @@
+package mpmcprio
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/wait"
+)
+
+func TestStrict(t *testing.T) {
+	q := New(64, Strict)
+	vals := make([]uint64, 64)
+	for i, p := range rand.Perm(len(vals)) {
+		vals[i] = uint64(p)
+		if !q.TryInsert(vals[i], unsafe.Pointer(&vals[i])) {
+			t.Fatalf("unexpected failed insert %d", i)
+		}
+	}
+	if q.TryInsert(0, nil) {
+		t.Fatal("unexpected insert into full queue")
+	}
+	for exp := uint64(0); exp < uint64(len(vals)); exp++ {
+		ptr, deleted := q.TryDeleteMin()
+		if !deleted || *(*uint64)(ptr) != exp {
+			t.Fatalf("expected delete of %d", exp)
+		}
+	}
+	if _, deleted := q.TryDeleteMin(); deleted {
+		t.Fatal("unexpected delete from empty queue")
+	}
+}
+
+// TestRelaxedRank checks that relaxed deletes return values whose rank, the
+// number of values still queued with a lower priority, is on average within
+// twice the number of heaps.
+func TestRelaxedRank(t *testing.T) {
+	const n = 4096
+	for _, procs := range []int{1, 4, 16} {
+		prev := runtime.GOMAXPROCS(procs)
+		q := New(n, Relaxed)
+		runtime.GOMAXPROCS(prev)
+
+		vals := make([]uint64, n)
+		queued := make([]bool, n)
+		for i, p := range rand.Perm(n) {
+			vals[i] = uint64(p)
+			if !q.TryInsert(vals[i], unsafe.Pointer(&vals[i])) {
+				t.Fatalf("procs %d: unexpected failed insert %d", procs, i)
+			}
+			queued[p] = true
+		}
+		var total, max int
+		for i := 0; i < n; i++ {
+			ptr, deleted := q.TryDeleteMin()
+			if !deleted {
+				t.Fatalf("procs %d: unexpected failed delete %d", procs, i)
+			}
+			v := *(*uint64)(ptr)
+			rank := 0
+			for lower := uint64(0); lower < v; lower++ {
+				if queued[lower] {
+					rank++
+				}
+			}
+			queued[v] = false
+			total += rank
+			if rank > max {
+				max = rank
+			}
+		}
+		nheaps := len(q.heaps)
+		mean := float64(total) / n
+		t.Logf("procs %d, %d heaps: mean rank %.2f, max %d", procs, nheaps, mean, max)
+		if mean > float64(2*nheaps) {
+			t.Errorf("procs %d: mean rank %.2f exceeds twice the %d heaps", procs, mean, nheaps)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	if sz := unsafe.Sizeof(paddedHeap{}); sz%primitive.FalseShare != 0 || sz-unsafe.Sizeof(heap{}) >= primitive.FalseShare {
+		t.Errorf("paddedHeap is %d bytes for a %d byte heap", sz, unsafe.Sizeof(heap{}))
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	for _, mode := range []Mode{Strict, Relaxed} {
+		q := New(16, mode)
+		const producers, perProducer = 4, 5000
+		vals := make([]uint64, producers*perProducer)
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := p * perProducer; i < (p+1)*perProducer; i++ {
+					vals[i] = uint64(i)
+					q.Insert(vals[i], unsafe.Pointer(&vals[i]))
+				}
+			}(p)
+		}
+		seen := make([]int, len(vals))
+		var mu sync.Mutex
+		for c := 0; c < producers; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perProducer; i++ {
+					v := *(*uint64)(q.DeleteMin())
+					mu.Lock()
+					seen[v]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		for v, n := range seen {
+			if n != 1 {
+				t.Fatalf("mode %d: value %d deleted %d times", mode, v, n)
+			}
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	q := NewWait(2, Strict, wait.NewFutex(), wait.NewFutex())
+	vals := []uint64{0, 1, 2}
+	got := make(chan uint64)
+	go func() { got <- *(*uint64)(q.DeleteMin()) }()
+	select {
+	case v := <-got:
+		t.Fatalf("unexpected delete of %d from empty queue", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.Insert(vals[1], unsafe.Pointer(&vals[1]))
+	if v := <-got; v != 1 {
+		t.Fatalf("got delete of %d, expected 1", v)
+	}
+
+	q.Insert(vals[2], unsafe.Pointer(&vals[2]))
+	q.Insert(vals[1], unsafe.Pointer(&vals[1]))
+	done := make(chan struct{})
+	go func() {
+		q.Insert(vals[0], unsafe.Pointer(&vals[0]))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("unexpected insert into full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if v := *(*uint64)(q.DeleteMin()); v != 1 {
+		t.Fatalf("got delete of %d, expected 1", v)
+	}
+	<-done
+	for _, exp := range []uint64{0, 2} {
+		if v := *(*uint64)(q.DeleteMin()); v != exp {
+			t.Fatalf("got delete of %d, expected %d", v, exp)
+		}
+	}
+}
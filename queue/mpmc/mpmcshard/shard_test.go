@@ -0,0 +1,125 @@
+package mpmcshard_test
+
+import (
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+	"github.com/twmb/dash/queue/mpmc/mpmcshard"
+	"github.com/twmb/dash/queue/queuetest"
+)
+
+const shards = 4
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, queuetest.Config{
+		New:       func(size uint) queue.TryQueue { return mpmcshard.New(shards, size) },
+		Capacity:  func(size uint) int { return shards * queuetest.Next2Min2(size) },
+		Producers: 4,
+		Consumers: 4,
+		Relaxed:   true,
+	})
+}
+
+func TestHints(t *testing.T) {
+	q := mpmcshard.New(shards, 4)
+	vals := make([]int, 6)
+	for i := range vals {
+		vals[i] = i
+	}
+	// Fill shard 0; the fifth value spills to shard 1.
+	for i := 0; i < 5; i++ {
+		if !q.TryEnqueueHint(0, unsafe.Pointer(&vals[i])) {
+			t.Fatalf("unexpected failed enqueue %d", i)
+		}
+	}
+	// A value in our home shard is preferred over older values elsewhere.
+	q.TryEnqueueHint(2, unsafe.Pointer(&vals[5]))
+	expect := func(hint uint, exp int) {
+		t.Helper()
+		ptr, dequeued := q.TryDequeueHint(hint)
+		if !dequeued || *(*int)(ptr) != exp {
+			t.Fatalf("hint %d: expected dequeue of %d", hint, exp)
+		}
+	}
+	expect(2, 5)
+	// With shards 2 and 3 empty, hint 2 steals from shard 0, in order,
+	// before shard 1.
+	for i := 0; i < 4; i++ {
+		expect(2, i)
+	}
+	expect(2, 4)
+	if _, dequeued := q.TryDequeueHint(2); dequeued {
+		t.Fatal("unexpected dequeue from empty queue")
+	}
+}
+
+// TestRelaxation checks that, with dequeuers cycling through every shard as
+// their home, no value is overtaken by more than k = (shards - 1) * size
+// values enqueued after it.
+func TestRelaxation(t *testing.T) {
+	const size, n = 8, 20000
+	q := mpmcshard.New(shards, size)
+	rng := rand.New(rand.NewSource(1))
+	seqs := make([]int, n)
+	var enqueued, dequeued, maxOvertaken int
+	// done[i] is whether seq i has been dequeued.
+	done := make([]bool, n)
+	var hint uint
+	for dequeued < n {
+		if enqueued < n && rng.Intn(2) == 0 {
+			seqs[enqueued] = enqueued
+			if q.TryEnqueueHint(uint(rng.Intn(shards)), unsafe.Pointer(&seqs[enqueued])) {
+				enqueued++
+			}
+			continue
+		}
+		ptr, ok := q.TryDequeueHint(hint)
+		hint++
+		if !ok {
+			continue
+		}
+		seq := *(*int)(ptr)
+		overtaken := 0
+		for later := seq + 1; later < enqueued; later++ {
+			if done[later] {
+				overtaken++
+			}
+		}
+		if overtaken > maxOvertaken {
+			maxOvertaken = overtaken
+		}
+		done[seq] = true
+		dequeued++
+	}
+	if k := (shards - 1) * size; maxOvertaken > k {
+		t.Errorf("value overtaken by %d values, more than k = %d", maxOvertaken, k)
+	}
+	if maxOvertaken == 0 {
+		t.Error("no value was overtaken; expected a relaxed order")
+	}
+}
+
+// The benchmarks below compare the queue against mpmcdvq with the same total
+// capacity, with every goroutine both enqueueing and dequeueing.
+
+func benchmark(b *testing.B, q queue.TryQueue) {
+	v := 1
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for !q.TryEnqueue(unsafe.Pointer(&v)) {
+			}
+			for {
+				if _, ok := q.TryDequeue(); ok {
+					break
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkShard(b *testing.B) { benchmark(b, mpmcshard.New(shards, 512)) }
+
+func BenchmarkDVQ(b *testing.B) { benchmark(b, mpmcdvq.New(shards*512)) }
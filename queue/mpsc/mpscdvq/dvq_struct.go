@@ -15,6 +15,7 @@
 package mpscdvq
 
 import (
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/twmb/dash/primitive"
@@ -22,37 +23,154 @@ import (
 
 // See mpmc's mpmcdvq for full comments on the structs and consts.
 
-const cellSz = unsafe.Sizeof(cell{})
-
 type cell struct {
-	seq  uintptr
-	ptr  unsafe.Pointer
+	seq uintptr
+	ptr unsafe.Pointer
+}
+
+type paddedCell struct {
+	cell
 	_pad [primitive.FalseShare - primitive.UpSz]byte
 }
 
+const (
+	paddedCellSz = unsafe.Sizeof(paddedCell{})
+	cellSz       = unsafe.Sizeof(cell{})
+	lineCells    = primitive.FalseShare / cellSz
+)
+
 // Queue represents a multi-producer, single-consumer, fast queue.
 type Queue struct {
-	_pad0  [primitive.FalseShare - primitive.UpSz]byte
-	mask   uintptr
-	cells  []cell
-	_pad1  [primitive.FalseShare - primitive.UpSz]byte
-	enqPos uintptr
-	_pad2  [primitive.FalseShare - primitive.UpSz]byte
-	deqPos uintptr
-	_pad3  [primitive.FalseShare - primitive.UpSz]byte
+	_pad0      [primitive.FalseShare - primitive.UpSz]byte
+	mask       uintptr
+	cells      unsafe.Pointer
+	stride     uintptr
+	ncells     uintptr
+	lineMask   uintptr
+	lineShift  uintptr
+	lineShift2 uintptr
+	cellMask   uintptr
+	_pad1      [primitive.FalseShare - primitive.UpSz]byte
+	enqPos     uintptr
+	_pad2      [primitive.FalseShare - primitive.UpSz]byte
+	deqPos     uintptr
+	_pad3      [primitive.FalseShare - primitive.UpSz]byte
+	inflight   int32
+	_pad4      [primitive.FalseShare - primitive.UpSz]byte
 }
 
-// New returns a new Queue, with size rounded up to the next power of 2.
+// roundSize returns size rounded up to the next power of 2, and to at least 2.
+// A queue with a single cell cannot tell full from empty: after an enqueue,
+// the cell's seq is what the next lap's enqueuer expects of an empty cell.
+func roundSize(size uint) uintptr {
+	if size < 2 {
+		return 2
+	}
+	return primitive.Next2(uintptr(size))
+}
+
+// New returns a new Queue, with size rounded up to the next power of 2, and
+// to at least 2.
+//
+// Each cell in the queue is padded to avoid false sharing, meaning each cell
+// uses over primitive.FalseShare bytes. For large queues, NewCompact may be
+// preferable.
 func New(size uint) *Queue {
-	size2 := primitive.Next2(uintptr(size))
-	cells := make([]cell, size2+1)
-	for i := uintptr(0); i < size2+1; i++ {
-		cells[i].seq = i - 1
+	size2 := roundSize(size)
+	cells := make([]paddedCell, size2+1)
+
+	q := &Queue{
+		cells:  unsafe.Pointer(&cells[1]),
+		stride: paddedCellSz,
+		ncells: size2,
 	}
+	q.setSize(size2)
+	return q
+}
+
+// NewCompact returns a new Queue, with size rounded up to the next power of 2,
+// that packs multiple cells into each false sharing range, spreading
+// consecutive positions across different ranges.
+func NewCompact(size uint) *Queue {
+	size2 := roundSize(size)
+	cells := make([]cell, size2+2*lineCells)
 
 	q := &Queue{
-		mask:  size2 - 1,
-		cells: cells[1:],
+		cells:  unsafe.Pointer(&cells[lineCells]),
+		stride: cellSz,
+		ncells: size2,
+	}
+	q.setSize(size2)
+	return q
+}
+
+// Reuse returns a Queue with size rounded up to the next power of 2, reusing q
+// and its cells if q is non-nil and has at least that many cells. Otherwise,
+// Reuse allocates a new Queue with the same layout as q. q must not be in use.
+func Reuse(q *Queue, size uint) *Queue {
+	size2 := roundSize(size)
+	switch {
+	case q == nil:
+		return New(size)
+	case q.ncells < size2 && q.stride == cellSz:
+		return NewCompact(size)
+	case q.ncells < size2:
+		return New(size)
 	}
+	q.setSize(size2)
 	return q
 }
+
+func (q *Queue) setSize(size2 uintptr) {
+	q.mask = size2 - 1
+	q.lineMask = size2 - 1
+	q.lineShift, q.lineShift2, q.cellMask = 0, 0, 0
+	if q.stride == cellSz {
+		if lines := size2 / lineCells; lines > 1 {
+			for 1<<q.lineShift2 < lines {
+				q.lineShift2++
+			}
+			for 1<<q.lineShift < lineCells {
+				q.lineShift++
+			}
+			q.lineMask = lines - 1
+			q.cellMask = lineCells - 1
+		}
+	}
+	q.Reset()
+}
+
+// Reset empties the queue, discarding any values left in it. Reset must only be
+// called while the queue is quiescent.
+func (q *Queue) Reset() {
+	if primitive.Debug && !atomic.CompareAndSwapInt32(&q.inflight, 0, resetting) {
+		panic("mpscdvq: Reset while the queue is in use")
+	}
+	for idx := uintptr(0); idx < q.ncells; idx++ {
+		(*cell)(unsafe.Pointer(uintptr(q.cells) + idx*q.stride)).ptr = primitive.Null
+	}
+	for pos := uintptr(0); pos <= q.mask; pos++ {
+		q.cell(pos).seq = pos
+	}
+	q.enqPos, q.deqPos = 0, 0
+	if primitive.Debug {
+		atomic.StoreInt32(&q.inflight, 0)
+	}
+}
+
+const resetting = -1 << 30
+
+func (q *Queue) enter() {
+	if atomic.AddInt32(&q.inflight, 1) < 0 {
+		panic("mpscdvq: operation concurrent with Reset")
+	}
+}
+
+func (q *Queue) exit() {
+	atomic.AddInt32(&q.inflight, -1)
+}
+
+func (q *Queue) cell(pos uintptr) *cell {
+	idx := (pos&q.lineMask)<<q.lineShift | (pos>>q.lineShift2)&q.cellMask
+	return (*cell)(unsafe.Pointer(uintptr(q.cells) + idx*q.stride))
+}
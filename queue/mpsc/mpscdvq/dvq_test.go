@@ -0,0 +1,87 @@
+package mpscdvq_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/mpsc/mpscdvq"
+	"github.com/twmb/dash/queue/queuetest"
+)
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, queuetest.Config{
+		New:       func(size uint) queue.TryQueue { return mpscdvq.New(size) },
+		Capacity:  queuetest.Next2Min2,
+		Producers: 4,
+	})
+}
+
+func FuzzOps(f *testing.F) {
+	queuetest.Fuzz(f, queuetest.Config{
+		New:      func(size uint) queue.TryQueue { return mpscdvq.New(size) },
+		Capacity: queuetest.Next2Min2,
+	})
+}
+
+var vals [256]int
+
+// use runs q, of the given size, through a few laps, leaving it half full.
+func use(t *testing.T, q *mpscdvq.Queue, size int) {
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < size; i++ {
+			if !q.TryEnqueue(unsafe.Pointer(&vals[i])) {
+				t.Fatalf("lap %d: unable to enqueue %d of %d", lap, i, size)
+			}
+		}
+		for i := 0; i < size; i++ {
+			if _, dequeued := q.TryDequeue(); !dequeued {
+				t.Fatalf("lap %d: unable to dequeue %d of %d", lap, i, size)
+			}
+		}
+	}
+	for i := 0; i < size/2; i++ {
+		q.TryEnqueue(unsafe.Pointer(&vals[i]))
+	}
+}
+
+// expectEmpty checks that q is empty and holds exactly size values in order.
+func expectEmpty(t *testing.T, q *mpscdvq.Queue, size int) {
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue from reused queue")
+	}
+	for i := 0; i < size; i++ {
+		if !q.TryEnqueue(unsafe.Pointer(&vals[i])) {
+			t.Fatalf("unable to enqueue %d into reused queue of size %d", i, size)
+		}
+	}
+	if q.TryEnqueue(unsafe.Pointer(&vals[size])) {
+		t.Fatalf("enqueued past reused queue size %d", size)
+	}
+	for i := 0; i < size; i++ {
+		if ptr, _ := q.TryDequeue(); ptr != unsafe.Pointer(&vals[i]) {
+			t.Fatalf("dequeue %d from reused queue out of order", i)
+		}
+	}
+}
+
+// TestReuse checks that Reuse empties used, wrapped queues of either layout,
+// keeping their cells when shrinking and allocating when growing.
+func TestReuse(t *testing.T) {
+	for _, newQ := range []func(uint) *mpscdvq.Queue{mpscdvq.New, mpscdvq.NewCompact} {
+		q := newQ(64)
+		use(t, q, 64)
+		if r := mpscdvq.Reuse(q, 16); r != q {
+			t.Error("Reuse allocated when shrinking")
+		}
+		expectEmpty(t, q, 16)
+
+		use(t, q, 16)
+		r := mpscdvq.Reuse(q, 100)
+		if r == q {
+			t.Error("Reuse kept cells too few for the new size")
+		}
+		expectEmpty(t, r, 128)
+	}
+	expectEmpty(t, mpscdvq.Reuse(nil, 3), 4)
+}
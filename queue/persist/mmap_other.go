@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package persist
+
+func mmap(path string, size int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func munmap(b []byte) error {
+	return ErrUnsupported
+}
+
+func msync(b []byte) error {
+	return ErrUnsupported
+}
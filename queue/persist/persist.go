@@ -0,0 +1,423 @@
+// Package persist provides a durable multi-producer single-consumer queue of
+// byte records, backed by mmap'd segment files in a directory.
+//
+// Records are appended to fixed size segment files. Enqueueing mirrors the dvq
+// queues: a producer reserves space for its record (and a sequence number)
+// under a short lock, copies its record in without the lock, and then
+// atomically publishes the record's length, similar to how dvq cells publish
+// their seq. The consumer reads records in sequence order, stopping at the
+// first record that is not yet published.
+//
+// Records are not deleted when dequeued. Instead, the consumer acknowledges
+// records with Ack, which is cumulative: acknowledging a sequence number
+// acknowledges every record before it. The acknowledged position is persisted
+// alongside the segments, and when a queue is reopened, dequeueing restarts
+// from the first unacknowledged record. Anything dequeued but not acknowledged
+// before a crash or restart is replayed.
+//
+// When a record does not fit in the current segment, the queue rotates to a
+// new segment file. Once every record in a segment is acknowledged, the
+// segment is deleted, compacting the queue.
+//
+// Writes are made durable by Sync, which flushes all segments and then the
+// acknowledged position. On open, the queue scans all segments, validating
+// record checksums; the first unpublished or corrupt record (for example, from
+// a crash in the middle of a write) marks the end of the queue, and anything
+// after it is discarded. Records enqueued after the last Sync may be lost in a
+// crash.
+//
+// Close may be called while the consumer is blocked in Dequeue, which then
+// returns ErrClosed.
+//
+// Segment files are written in native byte order and are not portable across
+// architectures. This package currently only supports Linux; elsewhere, Open
+// returns ErrUnsupported.
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/wait"
+)
+
+var _ queue.Closer = (*Queue)(nil)
+
+var (
+	// ErrTooLarge is returned from Enqueue if a record cannot fit in a
+	// segment.
+	ErrTooLarge = errors.New("persist: record too large for segment")
+	// ErrClosed is returned from Enqueue, Dequeue and Ack after Close.
+	ErrClosed = errors.New("persist: queue closed")
+	// ErrSegSize is returned from Open if the queue's existing segments
+	// are not the requested segment size.
+	ErrSegSize = errors.New("persist: segment size mismatch")
+	// ErrUnsupported is returned from Open on platforms without mmap
+	// support.
+	ErrUnsupported = errors.New("persist: unsupported platform")
+)
+
+// Queue represents a durable multi-producer, single-consumer queue.
+type Queue struct {
+	dir     string
+	segSize int
+
+	// inflight is read locked by producers while they copy records into
+	// reserved space, and write locked by Sync to wait for them.
+	inflight sync.RWMutex
+
+	// mu protects segs, the write position, and closed.
+	mu     sync.Mutex
+	segs   []*segment
+	wseg   *segment
+	woff   int
+	wseq   uint64
+	closed bool
+
+	// syncMu keeps compaction from unmapping segments while Sync is
+	// flushing them.
+	syncMu sync.Mutex
+
+	// The read position is owned by the single consumer. rmu is held
+	// while the consumer reads or acknowledges, so that Close can wait
+	// for it before unmapping; rclosed is set by Close under rmu.
+	rmu     sync.Mutex
+	rseg    *segment
+	roff    int
+	rseq    uint64
+	rclosed bool
+
+	// ack is the mmap'd ack file, holding the sequence number of the
+	// first unacknowledged record.
+	ack []byte
+	w   wait.Strategy
+}
+
+func (q *Queue) committed() *uint64 {
+	return (*uint64)(unsafe.Pointer(&q.ack[0]))
+}
+
+// Open opens the queue in dir, creating dir if necessary and recovering any
+// records left from a previous open. segSize, the size of each segment file,
+// is rounded up to the page size; it bounds the size of a record. Reopening a
+// queue must use the segment size it was created with, otherwise Open
+// returns ErrSegSize and leaves the queue's files untouched.
+func Open(dir string, segSize int) (*Queue, error) {
+	return OpenWait(dir, segSize, block.New())
+}
+
+// OpenWait is Open, with Dequeue waiting with w rather than a block.
+func OpenWait(dir string, segSize int, w wait.Strategy) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	page := os.Getpagesize()
+	segSize = (segSize + page - 1) / page * page
+	if segSize == 0 {
+		segSize = page
+	}
+
+	ack, err := mmap(filepath.Join(dir, ackFile), page)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:     dir,
+		segSize: segSize,
+		ack:     ack,
+		w:       w,
+	}
+	if err = q.recover(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// recover opens all segments, finding the end of valid records and the
+// first unacknowledged record.
+func (q *Queue) recover() error {
+	committed := atomic.LoadUint64(q.committed())
+	bases, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		bases = append(bases, committed)
+	}
+
+	seq := bases[0]
+	var rseg *segment
+	var roff int
+	// full is whether the last segment we opened has no room left, and
+	// tail is whether we found the end of our valid records.
+	var full, tail bool
+	for _, base := range bases {
+		if tail || base != seq {
+			// Everything after the end of our valid records is
+			// discarded.
+			tail = true
+			if err = os.Remove(segPath(q.dir, base)); err != nil {
+				return err
+			}
+			continue
+		}
+		seg, err := openSegment(q.dir, base, q.segSize)
+		if err != nil {
+			return err
+		}
+		q.segs = append(q.segs, seg)
+		q.wseg = seg
+
+		off := 0
+		for {
+			p, end := seg.read(off)
+			if full = end; end {
+				break
+			}
+			// An unpublished record, or one with a corrupt
+			// length or crc, ends our valid records.
+			if p == nil || !seg.valid(off, p) {
+				seg.truncate(off)
+				tail = true
+				break
+			}
+			if seq == committed {
+				rseg, roff = seg, off
+			}
+			seq++
+			off += recordSz(len(p))
+		}
+		q.woff = off
+	}
+	q.wseq = seq
+	if full {
+		seg, err := openSegment(q.dir, seq, q.segSize)
+		if err != nil {
+			return err
+		}
+		q.wseg.markEnd(q.woff)
+		q.segs = append(q.segs, seg)
+		q.wseg, q.woff = seg, 0
+	}
+
+	// If every record is acknowledged (or the ack file is somehow past
+	// or behind our records), we start reading from the bounds of what
+	// we have.
+	switch {
+	case rseg != nil:
+	case committed < q.segs[0].base:
+		committed, rseg, roff = q.segs[0].base, q.segs[0], 0
+	default:
+		committed, rseg, roff = seq, q.wseg, q.woff
+	}
+	atomic.StoreUint64(q.committed(), committed)
+	q.rseg, q.roff, q.rseq = rseg, roff, committed
+	return q.compact()
+}
+
+// Enqueue appends a record to the queue, returning its sequence number. The
+// record is copied; p can be reused once Enqueue returns.
+func (q *Queue) Enqueue(p []byte) (seq uint64, err error) {
+	need := recordSz(len(p))
+	if need > q.segSize {
+		return 0, ErrTooLarge
+	}
+
+	q.inflight.RLock()
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.inflight.RUnlock()
+		return 0, ErrClosed
+	}
+	if q.woff+need > q.segSize {
+		seg, err := openSegment(q.dir, q.wseq, q.segSize)
+		if err != nil {
+			q.mu.Unlock()
+			q.inflight.RUnlock()
+			return 0, err
+		}
+		// The new segment must be visible to the reader before the
+		// reader can see the end marker.
+		q.segs = append(q.segs, seg)
+		q.wseg.markEnd(q.woff)
+		q.wseg, q.woff = seg, 0
+	}
+	seg, off := q.wseg, q.woff
+	seq = q.wseq
+	q.woff += need
+	q.wseq++
+	q.mu.Unlock()
+
+	seg.write(off, p)
+	q.inflight.RUnlock()
+	q.w.Signal()
+	return seq, nil
+}
+
+// nextSegment returns the segment after s, or nil if the writer has not yet
+// rotated past s.
+func (q *Queue) nextSegment(s *segment) *segment {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, seg := range q.segs[:len(q.segs)-1] {
+		if seg == s {
+			return q.segs[i+1]
+		}
+	}
+	return nil
+}
+
+// TryDequeue returns a copy of the next record and its sequence number. If no
+// published record is available, or the queue is closed, this will return
+// failure. TryDequeue must only be called by one goroutine at a time.
+func (q *Queue) TryDequeue() (seq uint64, p []byte, dequeued bool) {
+	seq, p, dequeued, _ = q.tryDequeue()
+	return
+}
+
+// tryDequeue is TryDequeue, also returning whether the queue is closed.
+func (q *Queue) tryDequeue() (seq uint64, p []byte, dequeued, closed bool) {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	if q.rclosed {
+		return 0, nil, false, true
+	}
+	for {
+		rec, end := q.rseg.read(q.roff)
+		if end {
+			next := q.nextSegment(q.rseg)
+			if next == nil {
+				return
+			}
+			q.rseg, q.roff = next, 0
+			continue
+		}
+		if rec == nil {
+			return
+		}
+		seq = q.rseq
+		p = append([]byte(nil), rec...)
+		q.rseq++
+		q.roff += recordSz(len(rec))
+		return seq, p, true, false
+	}
+}
+
+// Dequeue returns a copy of the next record and its sequence number, blocking
+// until a record is published or the queue is closed, in which case Dequeue
+// returns ErrClosed. Dequeue must only be called by one goroutine at a time.
+func (q *Queue) Dequeue() (uint64, []byte, error) {
+	var seq uint64
+	var p []byte
+	var closed bool
+	q.w.Do(func() bool {
+		var dequeued bool
+		seq, p, dequeued, closed = q.tryDequeue()
+		return dequeued || closed
+	})
+	if closed {
+		return 0, nil, ErrClosed
+	}
+	return seq, p, nil
+}
+
+// Ack acknowledges every record up to and including seq, deleting any
+// segments that no longer contain unacknowledged records. Acknowledging a
+// record that has not been dequeued is an error. Ack must only be called by
+// the consumer.
+func (q *Queue) Ack(seq uint64) error {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	if q.rclosed {
+		return ErrClosed
+	}
+	if seq >= q.rseq {
+		return fmt.Errorf("persist: ack of undelivered record %d", seq)
+	}
+	if seq < atomic.LoadUint64(q.committed()) {
+		return nil
+	}
+	atomic.StoreUint64(q.committed(), seq+1)
+	return q.compact()
+}
+
+// compact deletes segments whose records are all acknowledged.
+func (q *Queue) compact() error {
+	committed := atomic.LoadUint64(q.committed())
+	q.syncMu.Lock()
+	defer q.syncMu.Unlock()
+	for {
+		q.mu.Lock()
+		// The reader may sit at the end of a fully acknowledged
+		// segment before moving to the next, so we never delete the
+		// reader's segment.
+		if len(q.segs) < 2 || q.segs[1].base > committed || q.segs[0] == q.rseg {
+			q.mu.Unlock()
+			return nil
+		}
+		seg := q.segs[0]
+		q.segs[0] = nil
+		q.segs = q.segs[1:]
+		q.mu.Unlock()
+		if err := seg.remove(); err != nil {
+			return err
+		}
+	}
+}
+
+// Sync flushes every record enqueued before Sync was called, and then the
+// acknowledged position, to disk.
+func (q *Queue) Sync() error {
+	q.syncMu.Lock()
+	defer q.syncMu.Unlock()
+
+	// Wait for in flight writes to finish and snapshot the segments to
+	// flush. Records reserved after this are not our concern.
+	q.inflight.Lock()
+	q.mu.Lock()
+	segs := append([]*segment(nil), q.segs...)
+	q.mu.Unlock()
+	q.inflight.Unlock()
+
+	for _, seg := range segs {
+		if err := msync(seg.data); err != nil {
+			return err
+		}
+	}
+	return msync(q.ack)
+}
+
+// Close syncs and closes the queue, waking a consumer blocked in Dequeue.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	// Waiting for rmu keeps us from unmapping segments under an in
+	// progress dequeue or ack.
+	q.rmu.Lock()
+	q.rclosed = true
+	q.rmu.Unlock()
+	q.w.Signal()
+
+	err := q.Sync()
+	for _, seg := range q.segs {
+		if cerr := seg.close(); err == nil {
+			err = cerr
+		}
+	}
+	q.segs = nil
+	if cerr := munmap(q.ack); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/dash/wait"
+)
+
+func open(t *testing.T, dir string) *Queue {
+	q, err := Open(dir, 4096)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	return q
+}
+
+func enqueue(t *testing.T, q *Queue, recs ...string) {
+	for _, rec := range recs {
+		if _, err := q.Enqueue([]byte(rec)); err != nil {
+			t.Fatalf("unable to enqueue: %v", err)
+		}
+	}
+}
+
+func expectDequeues(t *testing.T, q *Queue, firstSeq uint64, recs ...string) {
+	for i, exp := range recs {
+		seq, p, dequeued := q.TryDequeue()
+		if !dequeued {
+			t.Fatalf("expected dequeue of %q", exp)
+		}
+		if seq != firstSeq+uint64(i) || string(p) != exp {
+			t.Fatalf("got dequeue %d %q, expected %d %q", seq, p, firstSeq+uint64(i), exp)
+		}
+	}
+	if _, _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue from empty queue")
+	}
+}
+
+func segments(t *testing.T, dir string) int {
+	bases, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(bases)
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	enqueue(t, q, "a", "", "bb", "ccc")
+	expectDequeues(t, q, 0, "a", "", "bb", "ccc")
+	if err := q.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(4); err == nil {
+		t.Error("expected error acking undelivered record")
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything after our ack is replayed.
+	q = open(t, dir)
+	expectDequeues(t, q, 2, "bb", "ccc")
+	enqueue(t, q, "d")
+	expectDequeues(t, q, 4, "d")
+	q.Ack(4)
+	q.Close()
+
+	q = open(t, dir)
+	defer q.Close()
+	expectDequeues(t, q, 5)
+}
+
+func TestRotateCompact(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	if _, err := q.Enqueue(make([]byte, 4096)); err != ErrTooLarge {
+		t.Fatalf("got err %v, expected ErrTooLarge", err)
+	}
+
+	// Each 1000 byte record uses 1008 bytes; four fit per segment.
+	var recs []string
+	for i := 0; i < 10; i++ {
+		rec := fmt.Sprintf("%01000d", i)
+		recs = append(recs, rec)
+		enqueue(t, q, rec)
+	}
+	if n := segments(t, dir); n != 3 {
+		t.Fatalf("got %d segments, expected 3", n)
+	}
+	expectDequeues(t, q, 0, recs...)
+	q.Ack(2)
+	if n := segments(t, dir); n != 3 {
+		t.Fatalf("got %d segments after acking into the first, expected 3", n)
+	}
+	q.Ack(4)
+	if n := segments(t, dir); n != 2 {
+		t.Fatalf("got %d segments after acking past the first, expected 2", n)
+	}
+	q.Close()
+
+	q = open(t, dir)
+	defer q.Close()
+	expectDequeues(t, q, 5, recs[5:]...)
+	q.Ack(9)
+	if n := segments(t, dir); n != 1 {
+		t.Fatalf("got %d segments after acking everything, expected 1", n)
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	enqueue(t, q, "a", "b", "c")
+	// Corrupt the last record's data, as if we crashed mid write.
+	q.segs[0].data[2*recordSz(1)+hdrSz] = 'x'
+	q.Close()
+
+	q = open(t, dir)
+	defer q.Close()
+	expectDequeues(t, q, 0, "a", "b")
+	enqueue(t, q, "d")
+	expectDequeues(t, q, 2, "d")
+}
+
+func TestCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	enqueue(t, q, "a", "b", "c")
+	// Corrupt the second record's length to run past the segment.
+	*q.segs[0].lenAt(recordSz(1)) = 1 << 20
+	q.Close()
+
+	q = open(t, dir)
+	defer q.Close()
+	expectDequeues(t, q, 0, "a")
+	enqueue(t, q, "d")
+	expectDequeues(t, q, 1, "d")
+}
+
+func TestSegSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	enqueue(t, q, "a", "b")
+	q.Close()
+
+	if _, err := Open(dir, 2*4096); !errors.Is(err, ErrSegSize) {
+		t.Fatalf("got err %v reopening with a larger segment size, expected ErrSegSize", err)
+	}
+
+	// The failed open must not have touched our records.
+	q = open(t, dir)
+	defer q.Close()
+	expectDequeues(t, q, 0, "a", "b")
+}
+
+func TestConcurrent(t *testing.T) {
+	q := open(t, filepath.Join(t.TempDir(), "q"))
+	defer q.Close()
+	const producers, perProducer = 4, 1000
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				enqueue(t, q, fmt.Sprintf("%d %d", p, i))
+			}
+		}(p)
+	}
+	next := make([]int, producers)
+	for n := 0; n < producers*perProducer; n++ {
+		seq, rec, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(n) {
+			t.Fatalf("got seq %d, expected %d", seq, n)
+		}
+		var p, i int
+		fmt.Sscanf(string(rec), "%d %d", &p, &i)
+		if i != next[p] {
+			t.Fatalf("producer %d: got %d, expected %d", p, i, next[p])
+		}
+		next[p]++
+		if n%100 == 0 {
+			q.Ack(seq)
+			q.Sync()
+		}
+	}
+	wg.Wait()
+}
+
+func TestDequeueWait(t *testing.T) {
+	q, err := OpenWait(t.TempDir(), 4096, wait.NewFutex())
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	defer q.Close()
+	got := make(chan string)
+	go func() {
+		_, p, _ := q.Dequeue()
+		got <- string(p)
+	}()
+	select {
+	case p := <-got:
+		t.Fatalf("unexpected dequeue of %q from empty queue", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+	enqueue(t, q, "a")
+	if p := <-got; p != "a" {
+		t.Fatalf("got dequeue of %q, expected \"a\"", p)
+	}
+}
+
+func TestCloseWakesDequeue(t *testing.T) {
+	q := open(t, t.TempDir())
+	errs := make(chan error)
+	go func() {
+		_, _, err := q.Dequeue()
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected dequeue return %v from empty queue", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrClosed) {
+		t.Fatalf("got dequeue error %v, expected ErrClosed", err)
+	}
+	if _, _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue after close")
+	}
+	if err := q.Ack(0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got ack error %v, expected ErrClosed", err)
+	}
+}
@@ -0,0 +1,146 @@
+package persist
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// hdrSz is the size of a record header: a uint32 length followed by
+	// a uint32 crc of the record data.
+	hdrSz = 8
+	// endMarker, in place of a record length, marks that the rest of a
+	// segment is unused and the next record is in the next segment.
+	endMarker = ^uint32(0)
+
+	segSuffix = ".seg"
+	ackFile   = "ack"
+)
+
+// A record is laid out as
+//
+//     length+1 | crc | data | padding to 8 bytes
+//
+// where the length is stored plus one so that a zero length means the record
+// has not been written yet. Writers fill in the data and crc before
+// atomically storing the length, publishing the record to the reader.
+
+// recordSz returns the space a record with n bytes of data uses.
+func recordSz(n int) int {
+	return hdrSz + (n+7)&^7
+}
+
+// segment is one mmap'd file of records.
+type segment struct {
+	// base is the sequence number of the first record in the segment,
+	// and is also the name of the segment's file.
+	base uint64
+	path string
+	data []byte
+}
+
+func segPath(dir string, base uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segSuffix))
+}
+
+func openSegment(dir string, base uint64, size int) (*segment, error) {
+	path := segPath(dir, base)
+	data, err := mmap(path, size)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{base: base, path: path, data: data}, nil
+}
+
+// listSegments returns the bases of all segment files in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segSuffix))
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]uint64, 0, len(names))
+	for _, name := range names {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segSuffix), 10, 64)
+		if err != nil {
+			continue // not ours
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+func (s *segment) lenAt(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.data[off]))
+}
+
+func (s *segment) crcAt(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.data[off+4]))
+}
+
+// write writes and publishes a record at off, which must have been reserved.
+func (s *segment) write(off int, p []byte) {
+	copy(s.data[off+hdrSz:], p)
+	*s.crcAt(off) = crc32.ChecksumIEEE(p)
+	atomic.StoreUint32(s.lenAt(off), uint32(len(p))+1)
+}
+
+// read returns the record at off. If the record is not yet published,
+// read returns a nil record. If the segment has no more records, read returns
+// end. A record whose length runs past the end of the segment can only be
+// corrupt, and read returns it as a nil record as well.
+func (s *segment) read(off int) (p []byte, end bool) {
+	if off+hdrSz > len(s.data) {
+		return nil, true
+	}
+	l := atomic.LoadUint32(s.lenAt(off))
+	switch l {
+	case 0:
+		return nil, false
+	case endMarker:
+		return nil, true
+	}
+	if off+hdrSz+int(l-1) > len(s.data) {
+		return nil, false
+	}
+	return s.data[off+hdrSz : off+hdrSz+int(l-1)], false
+}
+
+// valid returns whether the record at off, which must be published, has a
+// matching crc.
+func (s *segment) valid(off int, p []byte) bool {
+	return *s.crcAt(off) == crc32.ChecksumIEEE(p)
+}
+
+// markEnd marks that no more records are in the segment after off.
+func (s *segment) markEnd(off int) {
+	if off+hdrSz <= len(s.data) {
+		atomic.StoreUint32(s.lenAt(off), endMarker)
+	}
+}
+
+// truncate zeroes the segment from off on.
+func (s *segment) truncate(off int) {
+	tail := s.data[off:]
+	for i := range tail {
+		tail[i] = 0
+	}
+}
+
+func (s *segment) close() error {
+	return munmap(s.data)
+}
+
+func (s *segment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	return os.Remove(s.path)
+}
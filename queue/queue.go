@@ -0,0 +1,40 @@
+package queue
+
+import "unsafe"
+
+// TryQueue is a bounded queue that never blocks. TryEnqueue returns false if
+// the queue is full, and TryDequeue returns false if the queue is empty.
+//
+// Every queue in dash that takes and returns unsafe.Pointer's implements
+// TryQueue.
+type TryQueue interface {
+	TryEnqueue(unsafe.Pointer) bool
+	TryDequeue() (unsafe.Pointer, bool)
+}
+
+// BlockingQueue is a TryQueue that can also wait: Enqueue blocks while the
+// queue is full, and Dequeue blocks while the queue is empty.
+type BlockingQueue interface {
+	TryQueue
+	Enqueue(unsafe.Pointer)
+	Dequeue() unsafe.Pointer
+}
+
+// BatchQueue is a TryQueue that can enqueue and dequeue many values in one
+// call. TryEnqueueBatch enqueues values from the front of ptrs until the queue
+// is full, returning how many it enqueued. TryDequeueBatch dequeues into ptrs
+// until ptrs is full or the queue is empty, returning how many it dequeued.
+//
+// A batch is not atomic: values from concurrent operations may interleave
+// with a batch's values.
+type BatchQueue interface {
+	TryQueue
+	TryEnqueueBatch(ptrs []unsafe.Pointer) int
+	TryDequeueBatch(ptrs []unsafe.Pointer) int
+}
+
+// Closer is a queue that holds resources that must be released with Close.
+// The queue must not be used after it is closed.
+type Closer interface {
+	Close() error
+}
@@ -0,0 +1,171 @@
+package queuetest
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/queue"
+)
+
+// Resetter is implemented by queues that can be emptied for reuse.
+type Resetter interface {
+	Reset()
+}
+
+// The operations a fuzz input decodes to. Each byte after the first is one
+// operation: the low three bits pick the operation, and the remaining bits
+// are its argument.
+const (
+	opEnqueue = iota
+	opEnqueue2
+	opDequeue
+	opDequeue2
+	opEnqueueBatch
+	opDequeueBatch
+	opReset
+	opClose
+)
+
+// Fuzz fuzzes the configured queue from a single goroutine. Every input
+// decodes to a queue size, from the first byte, followed by a sequence of
+// enqueues, dequeues, batches, resets, and closes, and every result is
+// compared against a sequential model of a FIFO queue holding the queue's
+// capacity. Batches are skipped for queues that do not implement
+// queue.BatchQueue, resets for queues that do not implement Resetter, and
+// closes, which end the sequence, for queues that do not implement
+// queue.Closer.
+//
+//	func FuzzQueue(f *testing.F) {
+//		queuetest.Fuzz(f, queuetest.Config{
+//			New:      func(size uint) queue.TryQueue { return spscdvq.New(size) },
+//			Capacity: queuetest.Next2Min2,
+//		})
+//	}
+//
+// Only Config.New and Config.Capacity are used.
+func Fuzz(f *testing.F, cfg Config) {
+	f.Add([]byte{0, opEnqueue, opEnqueue, opDequeue, opDequeue, opDequeue})
+	f.Add([]byte{1, opEnqueue, opEnqueue, opDequeue, opEnqueue, opEnqueue, opDequeue, opDequeue})
+	f.Add([]byte{2, opEnqueueBatch | 3<<3, opDequeue, opEnqueueBatch | 2<<3, opDequeueBatch | 4<<3, opReset, opDequeue})
+	f.Add([]byte{3, opEnqueue, opDequeue, opEnqueue, opDequeue, opEnqueue, opDequeue, opEnqueue, opDequeue, opEnqueue, opDequeue})
+	f.Add([]byte{5, opEnqueueBatch | 31<<3, opDequeueBatch | 5<<3, opEnqueueBatch | 31<<3, opDequeueBatch | 31<<3, opClose})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		size := uint(data[0] % 33)
+		capacity := cfg.capacity(size)
+		q := cfg.New(size)
+		bq, _ := q.(queue.BatchQueue)
+		r, _ := q.(Resetter)
+		c, _ := q.(queue.Closer)
+		closed := false
+		defer func() {
+			if c != nil && !closed {
+				c.Close()
+			}
+		}()
+
+		// model holds the values the queue should hold, in order.
+		var model []unsafe.Pointer
+		var next int
+		value := func() unsafe.Pointer {
+			next++
+			v := next
+			return unsafe.Pointer(&v)
+		}
+
+		for i, b := range data[1:] {
+			arg := int(b >> 3)
+			switch b & 7 {
+			case opEnqueue, opEnqueue2:
+				v := value()
+				enqueued := q.TryEnqueue(v)
+				if want := len(model) < capacity; enqueued != want {
+					t.Fatalf("op %d: enqueue with %d of %d values queued returned %v", i, len(model), capacity, enqueued)
+				}
+				if enqueued {
+					model = append(model, v)
+				}
+
+			case opDequeue, opDequeue2:
+				v, dequeued := q.TryDequeue()
+				if want := len(model) > 0; dequeued != want {
+					t.Fatalf("op %d: dequeue with %d values queued returned %v", i, len(model), dequeued)
+				}
+				if dequeued {
+					if v != model[0] {
+						t.Fatalf("op %d: dequeued %p, expected %p", i, v, model[0])
+					}
+					model = model[1:]
+				}
+
+			case opEnqueueBatch:
+				if bq == nil {
+					continue
+				}
+				vs := make([]unsafe.Pointer, arg)
+				for j := range vs {
+					vs[j] = value()
+				}
+				n := bq.TryEnqueueBatch(vs)
+				want := capacity - len(model)
+				if want > len(vs) {
+					want = len(vs)
+				}
+				if n != want {
+					t.Fatalf("op %d: batch enqueue of %d with %d of %d values queued enqueued %d", i, len(vs), len(model), capacity, n)
+				}
+				model = append(model, vs[:n]...)
+
+			case opDequeueBatch:
+				if bq == nil {
+					continue
+				}
+				vs := make([]unsafe.Pointer, arg)
+				n := bq.TryDequeueBatch(vs)
+				want := len(model)
+				if want > len(vs) {
+					want = len(vs)
+				}
+				if n != want {
+					t.Fatalf("op %d: batch dequeue of %d with %d values queued dequeued %d", i, len(vs), len(model), n)
+				}
+				for j, v := range vs[:n] {
+					if v != model[j] {
+						t.Fatalf("op %d: batch dequeued %p at %d, expected %p", i, v, j, model[j])
+					}
+				}
+				model = model[n:]
+
+			case opReset:
+				if r == nil {
+					continue
+				}
+				r.Reset()
+				model = nil
+
+			case opClose:
+				if c == nil {
+					continue
+				}
+				closed = true
+				if err := c.Close(); err != nil {
+					t.Fatalf("op %d: close: %v", i, err)
+				}
+				return
+			}
+		}
+
+		// Whatever is left must drain in order.
+		for _, want := range model {
+			if v, dequeued := q.TryDequeue(); !dequeued || v != want {
+				t.Fatalf("draining: dequeued %p (%v), expected %p", v, dequeued, want)
+			}
+		}
+		if _, dequeued := q.TryDequeue(); dequeued {
+			t.Fatal("dequeued from a drained queue")
+		}
+	})
+}
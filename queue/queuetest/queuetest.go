@@ -0,0 +1,415 @@
+// Package queuetest provides a conformance test suite for dash queues.
+//
+// Any queue.TryQueue can plug into the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		queuetest.Run(t, queuetest.Config{
+//			New:       func(size uint) queue.TryQueue { return mpmcdvq.New(size) },
+//			Producers: 4,
+//			Consumers: 4,
+//		})
+//	}
+//
+// The suite checks that new queues are empty, that queues hold exactly their
+// capacity, that values are dequeued in FIFO order, and that under
+// concurrency every value is dequeued exactly once, with each producer's
+// values dequeued in the order they were enqueued. Unless the queue is
+// relaxed, histories of small concurrent runs are also checked for
+// linearizability with lincheck. If the queue also
+// implements queue.BatchQueue or queue.BlockingQueue, those operations are
+// checked too, and if it implements queue.Closer, every queue the suite
+// creates is closed.
+//
+// Run the suite with -race to check that a queue is race detector clean.
+//
+// Fuzz complements the suite with a fuzz target that checks single goroutine
+// sequences of operations against a model queue, which is where edge cases
+// around sizing and wraparound show up.
+package queuetest
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/lincheck"
+)
+
+// Config describes the queue under test.
+type Config struct {
+	// New returns a new, empty queue of the given size.
+	New func(size uint) queue.TryQueue
+	// Capacity, if non-nil, returns how many values a queue returned from
+	// New(size) holds. By default, a queue holds size rounded up to the
+	// next power of 2. Queues that round as the dvq queues do use
+	// Next2Min2.
+	Capacity func(size uint) int
+	// Producers and Consumers are the number of goroutines enqueueing and
+	// dequeueing in the concurrent tests. Zero means one; queues that only
+	// support a single producer or consumer must leave these at zero.
+	Producers int
+	Consumers int
+	// Relaxed skips checking FIFO order, for queues that do not guarantee
+	// it. Every value must still be dequeued exactly once.
+	Relaxed bool
+	// Messages is the number of values each producer enqueues in the
+	// concurrent tests. Zero means 10000.
+	Messages int
+}
+
+// msg is what the suite enqueues.
+type msg struct {
+	producer int
+	seq      int
+}
+
+// Next2Min2 returns size rounded up to the next power of 2, and to at least
+// 2, which is how many values a dvq queue of the given size holds.
+func Next2Min2(size uint) int {
+	if size < 2 {
+		return 2
+	}
+	return int(primitive.Next2(uintptr(size)))
+}
+
+func (cfg Config) capacity(size uint) int {
+	if cfg.Capacity != nil {
+		return cfg.Capacity(size)
+	}
+	return int(primitive.Next2(uintptr(size)))
+}
+
+func (cfg Config) new(t *testing.T, size uint) queue.TryQueue {
+	q := cfg.New(size)
+	if c, ok := q.(queue.Closer); ok {
+		t.Cleanup(func() {
+			if err := c.Close(); err != nil {
+				t.Errorf("close: %v", err)
+			}
+		})
+	}
+	return q
+}
+
+// Run runs the conformance suite against the configured queue, with each
+// check in its own subtest.
+func Run(t *testing.T, cfg Config) {
+	if cfg.Producers == 0 {
+		cfg.Producers = 1
+	}
+	if cfg.Consumers == 0 {
+		cfg.Consumers = 1
+	}
+	if cfg.Messages == 0 {
+		cfg.Messages = 10000
+	}
+	if testing.Short() {
+		cfg.Messages /= 10
+	}
+
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, cfg) })
+	t.Run("Full", func(t *testing.T) { testFull(t, cfg) })
+	t.Run("Interleaved", func(t *testing.T) { testInterleaved(t, cfg) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, cfg, false) })
+	if !cfg.Relaxed {
+		t.Run("Linearizable", func(t *testing.T) { testLinearizable(t, cfg) })
+	}
+	q := cfg.new(t, 2)
+	if _, ok := q.(queue.BatchQueue); ok {
+		t.Run("Batch", func(t *testing.T) { testBatch(t, cfg) })
+	}
+	if _, ok := q.(queue.BlockingQueue); ok {
+		t.Run("Blocking", func(t *testing.T) { testConcurrent(t, cfg, true) })
+	}
+}
+
+func testEmpty(t *testing.T, cfg Config) {
+	q := cfg.new(t, 8)
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("dequeued from new queue")
+	}
+	if bq, ok := q.(queue.BatchQueue); ok {
+		if n := bq.TryDequeueBatch(make([]unsafe.Pointer, 4)); n != 0 {
+			t.Fatalf("batch dequeued %d from new queue", n)
+		}
+	}
+}
+
+// checkOrder checks that ms are the values seq through seq+len(ms) of
+// producer 0, in order if the queue is not relaxed.
+func checkOrder(t *testing.T, cfg Config, ms []*msg, seq int) {
+	t.Helper()
+	seen := make(map[int]bool, len(ms))
+	for i, m := range ms {
+		if !cfg.Relaxed && m.seq != seq+i {
+			t.Fatalf("dequeue %d: got value %d, want %d", i, m.seq, seq+i)
+		}
+		if m.seq < seq || m.seq >= seq+len(ms) || seen[m.seq] {
+			t.Fatalf("dequeue %d: unexpected value %d", i, m.seq)
+		}
+		seen[m.seq] = true
+	}
+}
+
+func testFull(t *testing.T, cfg Config) {
+	for _, size := range []uint{2, 8, 33} {
+		q := cfg.new(t, size)
+		capacity := cfg.capacity(size)
+		seq := 0
+		// Multiple rounds wrap around the queue.
+		for round := 0; round < 3; round++ {
+			n := 0
+			for ; n <= capacity; n++ {
+				if !q.TryEnqueue(unsafe.Pointer(&msg{seq: seq + n})) {
+					break
+				}
+			}
+			if n != capacity {
+				t.Fatalf("size %d round %d: enqueued %d before full, want %d", size, round, n, capacity)
+			}
+
+			var ms []*msg
+			for {
+				ptr, dequeued := q.TryDequeue()
+				if !dequeued {
+					break
+				}
+				ms = append(ms, (*msg)(ptr))
+			}
+			if len(ms) != capacity {
+				t.Fatalf("size %d round %d: dequeued %d before empty, want %d", size, round, len(ms), capacity)
+			}
+			checkOrder(t, cfg, ms, seq)
+			seq += n
+		}
+	}
+}
+
+// testInterleaved runs a random single goroutine sequence of enqueues and
+// dequeues against a model.
+func testInterleaved(t *testing.T, cfg Config) {
+	const size = 8
+	q := cfg.new(t, size)
+	capacity := cfg.capacity(size)
+	rng := rand.New(rand.NewSource(1))
+
+	var model []int // queued values, in order
+	next := 0
+	for i := 0; i < 10*cfg.Messages; i++ {
+		if rng.Intn(2) == 0 {
+			enqueued := q.TryEnqueue(unsafe.Pointer(&msg{seq: next}))
+			if want := len(model) < capacity; enqueued != want {
+				t.Fatalf("op %d: enqueue with %d queued returned %v", i, len(model), enqueued)
+			}
+			if enqueued {
+				model = append(model, next)
+				next++
+			}
+			continue
+		}
+
+		ptr, dequeued := q.TryDequeue()
+		if want := len(model) > 0; dequeued != want {
+			t.Fatalf("op %d: dequeue with %d queued returned %v", i, len(model), dequeued)
+		}
+		if !dequeued {
+			continue
+		}
+		got := (*msg)(ptr).seq
+		if cfg.Relaxed {
+			for j, v := range model {
+				if v == got {
+					model = append(model[:j], model[j+1:]...)
+					break
+				}
+				if j == len(model)-1 {
+					t.Fatalf("op %d: dequeued unexpected value %d", i, got)
+				}
+			}
+			continue
+		}
+		if got != model[0] {
+			t.Fatalf("op %d: dequeued %d, want %d", i, got, model[0])
+		}
+		model = model[1:]
+	}
+}
+
+func testBatch(t *testing.T, cfg Config) {
+	const size = 8
+	q := cfg.new(t, size).(queue.BatchQueue)
+	capacity := cfg.capacity(size)
+
+	seq := 0
+	for round := 0; round < 3; round++ {
+		ptrs := make([]unsafe.Pointer, capacity+3)
+		for i := range ptrs {
+			ptrs[i] = unsafe.Pointer(&msg{seq: seq + i})
+		}
+		if n := q.TryEnqueueBatch(ptrs); n != capacity {
+			t.Fatalf("round %d: batch enqueued %d into empty queue, want %d", round, n, capacity)
+		}
+		if n := q.TryEnqueueBatch(ptrs[capacity:]); n != 0 {
+			t.Fatalf("round %d: batch enqueued %d into full queue", round, n)
+		}
+
+		// Dequeue in uneven chunks, with the last chunk larger than
+		// what remains.
+		var ms []*msg
+		buf := make([]unsafe.Pointer, 3)
+		for {
+			n := q.TryDequeueBatch(buf)
+			for _, ptr := range buf[:n] {
+				ms = append(ms, (*msg)(ptr))
+			}
+			if n < len(buf) {
+				break
+			}
+		}
+		if len(ms) != capacity {
+			t.Fatalf("round %d: batch dequeued %d, want %d", round, len(ms), capacity)
+		}
+		checkOrder(t, cfg, ms, seq)
+		seq += capacity
+	}
+}
+
+// testConcurrent runs producers and consumers concurrently, checking that
+// every value is dequeued once and each producer's values are dequeued in
+// order.
+func testConcurrent(t *testing.T, cfg Config, blocking bool) {
+	q := cfg.new(t, 16)
+	bq, _ := q.(queue.BlockingQueue)
+
+	msgs := make([][]msg, cfg.Producers)
+	seen := make([][]uint32, cfg.Producers)
+	for p := range msgs {
+		msgs[p] = make([]msg, cfg.Messages)
+		seen[p] = make([]uint32, cfg.Messages)
+		for i := range msgs[p] {
+			msgs[p][i] = msg{producer: p, seq: i}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < cfg.Producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := range msgs[p] {
+				ptr := unsafe.Pointer(&msgs[p][i])
+				if blocking {
+					bq.Enqueue(ptr)
+					continue
+				}
+				for !q.TryEnqueue(ptr) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+
+	// Consumers split the total between them up front, so that blocking
+	// dequeuers know when to stop.
+	total := cfg.Producers * cfg.Messages
+	errs := make(chan string, cfg.Consumers)
+	for c := 0; c < cfg.Consumers; c++ {
+		n := total / cfg.Consumers
+		if c == 0 {
+			n += total % cfg.Consumers
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			last := make([]int, cfg.Producers)
+			for i := range last {
+				last[i] = -1
+			}
+			for ; n > 0; n-- {
+				var ptr unsafe.Pointer
+				if blocking {
+					ptr = bq.Dequeue()
+				} else {
+					var dequeued bool
+					for ptr, dequeued = q.TryDequeue(); !dequeued; ptr, dequeued = q.TryDequeue() {
+						runtime.Gosched()
+					}
+				}
+				m := (*msg)(ptr)
+				atomic.AddUint32(&seen[m.producer][m.seq], 1)
+				if !cfg.Relaxed && m.seq <= last[m.producer] {
+					select {
+					case errs <- "producer values dequeued out of order":
+					default:
+					}
+				}
+				last[m.producer] = m.seq
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for p := range seen {
+		for i, n := range seen[p] {
+			if n != 1 {
+				t.Fatalf("producer %d value %d dequeued %d times", p, i, n)
+			}
+		}
+	}
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("dequeued from drained queue")
+	}
+}
+
+// testLinearizable records many short concurrent runs on small queues,
+// checking that each history is linearizable. Failed operations are allowed
+// to be spurious.
+func testLinearizable(t *testing.T, cfg Config) {
+	const (
+		size = 2
+		ops  = 4
+	)
+	runs := cfg.Messages / 20
+	m := lincheck.Model{Capacity: cfg.capacity(size)}
+	for run := 0; run < runs; run++ {
+		r := lincheck.NewRecorder(cfg.new(t, size))
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for p := 0; p < cfg.Producers; p++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for i := 0; i < ops; i++ {
+					r.TryEnqueue(unsafe.Pointer(new(msg)))
+				}
+			}()
+		}
+		for c := 0; c < cfg.Consumers; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for i := 0; i < ops; i++ {
+					r.TryDequeue()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if history := r.History(); !lincheck.Check(m, history) {
+			t.Fatalf("run %d: history not linearizable:\n%v", run, history)
+		}
+	}
+}
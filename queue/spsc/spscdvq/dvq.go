@@ -5,8 +5,11 @@ import (
 	"unsafe"
 
 	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue"
 )
 
+var _ queue.BatchQueue = (*Queue)(nil)
+
 // See mpmc's mpmcdvq for full comments. This code is that mpmc, whittled down
 // assuming there is max one enqueue concurrent with one dequeue.
 
@@ -14,7 +17,11 @@ import (
 // avoid the necessity of wrapping a heap allocated value in an interface,
 // which also goes on the heap. If the queue is full, this will return failure.
 func (q *Queue) TryEnqueue(ptr unsafe.Pointer) (enqueued bool) {
-	c := &q.cells[q.enqPos&q.mask]
+	if primitive.Debug {
+		q.enter()
+		defer q.exit()
+	}
+	c := q.cell(q.enqPos)
 	seq := atomic.LoadUintptr(&c.seq)
 	if seq < q.enqPos {
 		return
@@ -28,7 +35,11 @@ func (q *Queue) TryEnqueue(ptr unsafe.Pointer) (enqueued bool) {
 // TryDequeue dequeues a value from our queue. If the queue is empty, this
 // will return failure.
 func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
-	c := &q.cells[q.deqPos&q.mask]
+	if primitive.Debug {
+		q.enter()
+		defer q.exit()
+	}
+	c := q.cell(q.deqPos)
 	seq := atomic.LoadUintptr(&c.seq)
 	if seq < q.deqPos+1 {
 		return
@@ -39,3 +50,27 @@ func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
 	atomic.StoreUintptr(&c.seq, q.deqPos+q.mask)
 	return ptr, true
 }
+
+// TryEnqueueBatch enqueues values from the front of ptrs until the queue is
+// full, returning the number of values enqueued.
+func (q *Queue) TryEnqueueBatch(ptrs []unsafe.Pointer) int {
+	for i, ptr := range ptrs {
+		if !q.TryEnqueue(ptr) {
+			return i
+		}
+	}
+	return len(ptrs)
+}
+
+// TryDequeueBatch dequeues values into ptrs until ptrs is full or the queue is
+// empty, returning the number of values dequeued.
+func (q *Queue) TryDequeueBatch(ptrs []unsafe.Pointer) int {
+	for i := range ptrs {
+		ptr, dequeued := q.TryDequeue()
+		if !dequeued {
+			return i
+		}
+		ptrs[i] = ptr
+	}
+	return len(ptrs)
+}
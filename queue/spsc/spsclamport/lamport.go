@@ -0,0 +1,147 @@
+// Package spsclamport provides a concurrent single-producer single-consumer
+// fast queue based off Lamport's ring buffer, with each side caching the
+// other side's index.
+//
+// spscdvq loads and stores a sequence number in every cell, meaning both the
+// enqueuer and the dequeuer write to shared cells on every operation. Here,
+// the enqueuer and dequeuer each own one index, and each side keeps a private
+// copy of the other side's index. A side only reloads the other side's index
+// when its copy says the queue is full (for the enqueuer) or empty (for the
+// dequeuer). While the queue is neither close to full nor close to empty,
+// neither side touches the other side's index. The value cells are still
+// shared: the enqueuer writes each value, and the dequeuer clears each cell to
+// Null so that the queue does not keep dequeued values alive. Because the
+// sides work at different positions in the ring, they only write the same
+// cache line of cells when the queue is nearly full or nearly empty. This is
+// the approach used in FastForward (Giacomoni, Moseley and Vachharajani) and in
+// the cached-index variants of Lamport's queue.
+//
+// Queue's are forced to a multiplier-of-two size before returning. As with the
+// dvq queues, if enqueueing or dequeueing fails, enqueuers or dequeuers need to
+// backoff before attempting enqueueing or dequeueing again.
+package spsclamport
+
+import (
+	"unsafe"
+
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/queue"
+)
+
+var _ queue.BatchQueue = (*Queue)(nil)
+
+// Queue represents a single-producer, single-consumer, fast queue.
+type Queue struct {
+	_pad0 [primitive.FalseShare - primitive.UpSz]byte
+	// mask is the size of our queue - 1.
+	mask  uintptr
+	ptrs  []unsafe.Pointer
+	_pad1 [primitive.FalseShare - primitive.UpSz]byte
+	// enqPos is the next position to enqueue into. It is only written by
+	// the enqueuer.
+	enqPos uintptr
+	// deqCache is the enqueuer's copy of deqPos.
+	deqCache uintptr
+	_pad2    [primitive.FalseShare - primitive.UpSz]byte
+	// deqPos is the next position to dequeue from. It is only written by
+	// the dequeuer.
+	deqPos uintptr
+	// enqCache is the dequeuer's copy of enqPos.
+	enqCache uintptr
+	_pad3    [primitive.FalseShare - primitive.UpSz]byte
+}
+
+// New returns a new Queue, with size rounded up to the next power of 2.
+func New(size uint) *Queue {
+	size2 := primitive.Next2(uintptr(size))
+	// Pad a false sharing range on either side of our values to avoid
+	// sharing with other allocations.
+	pad := primitive.FalseShare / primitive.UpSz
+	ptrs := make([]unsafe.Pointer, size2+2*pad)
+	return &Queue{
+		mask: size2 - 1,
+		ptrs: ptrs[pad : pad+size2],
+	}
+}
+
+// TryEnqueue adds a value to our queue. TryEnqueue takes an unsafe.Pointer to
+// avoid the necessity of wrapping a heap allocated value in an interface,
+// which also goes on the heap. If the queue is full, this will return failure.
+func (q *Queue) TryEnqueue(ptr unsafe.Pointer) bool {
+	pos := q.enqPos
+	if pos-q.deqCache > q.mask {
+		// We think we are full; check whether the dequeuer has moved.
+		q.deqCache = primitive.LoadUintptr(&q.deqPos)
+		if pos-q.deqCache > q.mask {
+			return false
+		}
+	}
+	q.ptrs[pos&q.mask] = ptr
+	// Publish the value to the dequeuer.
+	primitive.StoreUintptr(&q.enqPos, pos+1)
+	return true
+}
+
+// TryDequeue dequeues a value from our queue. If the queue is empty, this
+// will return failure.
+func (q *Queue) TryDequeue() (ptr unsafe.Pointer, dequeued bool) {
+	pos := q.deqPos
+	if pos == q.enqCache {
+		// We think we are empty; check whether the enqueuer has moved.
+		q.enqCache = primitive.LoadUintptr(&q.enqPos)
+		if pos == q.enqCache {
+			return
+		}
+	}
+	ptr = q.ptrs[pos&q.mask]
+	q.ptrs[pos&q.mask] = primitive.Null
+	// Hand the cell back to the enqueuer.
+	primitive.StoreUintptr(&q.deqPos, pos+1)
+	return ptr, true
+}
+
+// TryEnqueueBatch enqueues values from the front of ptrs until the queue is
+// full, publishing them to the dequeuer all at once. It returns the number of
+// values enqueued.
+func (q *Queue) TryEnqueueBatch(ptrs []unsafe.Pointer) int {
+	pos := q.enqPos
+	n := uintptr(len(ptrs))
+	if free := q.mask + 1 - (pos - q.deqCache); free < n {
+		q.deqCache = primitive.LoadUintptr(&q.deqPos)
+		if free = q.mask + 1 - (pos - q.deqCache); free < n {
+			n = free
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	for i, ptr := range ptrs[:n] {
+		q.ptrs[(pos+uintptr(i))&q.mask] = ptr
+	}
+	primitive.StoreUintptr(&q.enqPos, pos+n)
+	return int(n)
+}
+
+// TryDequeueBatch dequeues values into ptrs until ptrs is full or the queue is
+// empty, handing their cells back to the enqueuer all at once. It returns the
+// number of values dequeued.
+func (q *Queue) TryDequeueBatch(ptrs []unsafe.Pointer) int {
+	pos := q.deqPos
+	n := uintptr(len(ptrs))
+	if avail := q.enqCache - pos; avail < n {
+		q.enqCache = primitive.LoadUintptr(&q.enqPos)
+		if avail = q.enqCache - pos; avail < n {
+			n = avail
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	for i := range ptrs[:n] {
+		idx := (pos + uintptr(i)) & q.mask
+		ptrs[i] = q.ptrs[idx]
+		q.ptrs[idx] = primitive.Null
+	}
+	primitive.StoreUintptr(&q.deqPos, pos+n)
+	return int(n)
+}
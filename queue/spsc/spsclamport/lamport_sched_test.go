@@ -0,0 +1,65 @@
+//go:build dashsched
+// +build dashsched
+
+package spsclamport
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/primitive"
+	"github.com/twmb/dash/sched"
+)
+
+// TestSchedules explores a producer and a consumer passing three values
+// through a queue of two, so that both sides must reload the other's index.
+// The check verifies the values arrive in order and that every cell is
+// cleared once the queue drains.
+func TestSchedules(t *testing.T) {
+	err := sched.Explore(sched.Config{}, func() sched.Scenario {
+		q := New(2)
+		vals := []int{0, 1, 2}
+		var got []int
+		return sched.Scenario{
+			Threads: []func(){
+				func() {
+					for i := range vals {
+						for !q.TryEnqueue(unsafe.Pointer(&vals[i])) {
+							primitive.Pause()
+						}
+					}
+				},
+				func() {
+					for len(got) < len(vals) {
+						ptr, dequeued := q.TryDequeue()
+						if !dequeued {
+							primitive.Pause()
+							continue
+						}
+						got = append(got, *(*int)(ptr))
+					}
+				},
+			},
+			Check: func() error {
+				for i, v := range got {
+					if v != i {
+						return fmt.Errorf("dequeued %v, expected in order", got)
+					}
+				}
+				for i, ptr := range q.ptrs {
+					if ptr != primitive.Null {
+						return fmt.Errorf("cell %d not cleared after dequeue", i)
+					}
+				}
+				if q.enqPos != 3 || q.deqPos != 3 {
+					return fmt.Errorf("ended at enqPos %d, deqPos %d", q.enqPos, q.deqPos)
+				}
+				return nil
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package spsclamport_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/twmb/dash/queue"
+	"github.com/twmb/dash/queue/queuetest"
+	"github.com/twmb/dash/queue/spsc/spsclamport"
+)
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, queuetest.Config{
+		New: func(size uint) queue.TryQueue { return spsclamport.New(size) },
+	})
+}
+
+func FuzzOps(f *testing.F) {
+	queuetest.Fuzz(f, queuetest.Config{
+		New: func(size uint) queue.TryQueue { return spsclamport.New(size) },
+	})
+}
+
+// TestBatchPartial checks that batches stop at full and empty, reloading the
+// other side's index once their cached copy runs out.
+func TestBatchPartial(t *testing.T) {
+	q := spsclamport.New(4)
+	vals := make([]int, 7)
+	ptrs := make([]unsafe.Pointer, len(vals))
+	for i := range vals {
+		vals[i] = i
+		ptrs[i] = unsafe.Pointer(&vals[i])
+	}
+	if n := q.TryEnqueueBatch(ptrs[:6]); n != 4 {
+		t.Fatalf("enqueued %d into size 4 queue, expected 4", n)
+	}
+	if q.TryEnqueue(ptrs[6]) {
+		t.Fatal("unexpected enqueue into full queue")
+	}
+	deq := make([]unsafe.Pointer, 8)
+	if n := q.TryDequeueBatch(deq[:3]); n != 3 {
+		t.Fatalf("dequeued %d, expected 3", n)
+	}
+	if n := q.TryEnqueueBatch(ptrs[4:]); n != 3 {
+		t.Fatalf("enqueued %d after dequeueing 3, expected 3", n)
+	}
+	n := q.TryDequeueBatch(deq[3:])
+	if n != 4 {
+		t.Fatalf("dequeued %d, expected 4", n)
+	}
+	for i, ptr := range deq[:7] {
+		if *(*int)(ptr) != i {
+			t.Fatalf("dequeue %d: got %d", i, *(*int)(ptr))
+		}
+	}
+	if _, dequeued := q.TryDequeue(); dequeued {
+		t.Fatal("unexpected dequeue from empty queue")
+	}
+}
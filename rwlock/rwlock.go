@@ -0,0 +1,202 @@
+// Package rwlock provides a spinning reader/writer lock with try lock
+// semantics.
+//
+// Unlike sync.RWMutex, readers can never slip in while a writer is pending:
+// the first writer to lock makes all new readers fail, and then waits for
+// existing readers to leave. Only one writer can be pending; further
+// TryLocks fail rather than queueing. This makes the lock a good fit for
+// collapsing many concurrent attempts at the same write into one write and
+// one pending write, which is how block.Block collapses signals.
+//
+// Lock and RLock block with backoff until they get the lock. Because writers
+// always win, a steady stream of writers using Lock can starve readers; a
+// lock created with NewFair gives readers waiting in RLock a turn after
+// every write unlock.
+//
+// The lock spins rather than parks. It is slower than sync.RWMutex for most
+// standard uses of a lock, and should only be used where its try semantics
+// or writer preference are needed.
+package rwlock
+
+import (
+	"github.com/twmb/dash/primitive"
+)
+
+// Lock is a spinning reader/writer lock with try lock semantics. The zero
+// Lock is an unlocked, unfair lock.
+type Lock struct {
+	write uint32
+	_pad0 [primitive.FalseShare - 4]byte
+	read  uint32
+	_pad1 [primitive.FalseShare - 4]byte
+
+	// fair is set for locks created with NewFair. rwaiting counts readers
+	// blocked in RLock, and readTurn is set when a write unlock has given
+	// those readers a turn.
+	fair     bool
+	rwaiting int32
+	readTurn uint32
+}
+
+// NewFair returns a new lock that gives readers blocked in RLock a turn
+// after every write unlock, before writers in Lock can lock again. Fairness
+// does not apply to TryLock, and a writer already pending still gets the
+// lock first.
+func NewFair() *Lock {
+	return &Lock{fair: true}
+}
+
+const highBit uint32 = 1 << 31
+
+// TryLock sets the lock in a write state. This function allows one pending
+// write lock; additional pending write locks return failure.
+func (l *Lock) TryLock() bool {
+	var write uint32
+	for {
+		// Add our lock desire, checking the state in the process.
+		write = primitive.AddUint32(&l.write, 1)
+		if write&highBit == 0 {
+			break
+		}
+		// If the high bit is set, the lock is being unlocked. We retry
+		// as we may now either be the first lock or the pending lock.
+		primitive.Gosched()
+	}
+
+	switch write {
+	case 1:
+		// We were the first to grab this lock - signal readers to exit
+		// and wait for them.
+		read := primitive.AddUint32(&l.read, highBit)
+		for read != highBit {
+			primitive.Gosched()
+			read = primitive.LoadUint32(&l.read)
+		}
+		return true
+	case 2:
+		// We were the second to grab this lock - we wait for the high
+		// bit to be set when unlocking. The unlocker will see multiple
+		// lock grabs and not reset the lock fully.
+		for write&highBit == 0 {
+			primitive.Gosched()
+			write = primitive.LoadUint32(&l.write)
+		}
+		// We have seen the high bit - set the lock back to the locked
+		// state.
+		primitive.StoreUint32(&l.write, 1)
+		return true
+	}
+	// We are not the first locker, nor the pending locker, and we did not
+	// see a lock unlocking. We can return.
+	return false
+}
+
+// WUnlock relinquishes our write lock.
+func (l *Lock) WUnlock() {
+	// We give waiting readers their turn before unlocking, so that no
+	// writer in Lock can slip in ahead of them.
+	if l.fair && primitive.LoadInt32(&l.rwaiting) > 0 {
+		primitive.StoreUint32(&l.readTurn, 1)
+	}
+	// If more writers attempted our lock, write&^highBit will be >1, and
+	// the try that got 2 will be waiting in pending state. That waiter
+	// will now see we have unlocked, so we can leave.
+	write := primitive.AddUint32(&l.write, highBit)
+	if write&^highBit > 1 {
+		return
+	}
+	// If nobody else attempted the lock by the time added the high bit,
+	// we must let readers continue (first) and then reset our write lock.
+	primitive.StoreUint32(&l.read, 0)
+	primitive.StoreUint32(&l.write, 0)
+}
+
+// TryRLock attempts to grab a reader lock, failing if a writer has locked.
+func (l *Lock) TryRLock() bool {
+	var swapped bool
+	read := primitive.LoadUint32(&l.read)
+	for {
+		if read&highBit != 0 { // writer has grabbed lock
+			return false
+		}
+		read, swapped = primitive.CompareAndSwapUint32(&l.read, read, read+1)
+		if swapped { // we got a read lock
+			return true
+		}
+	}
+}
+
+// RUnlock decrements the lock by one reader. This is the counterpart to
+// TryRLock or RLock.
+func (l *Lock) RUnlock() {
+	primitive.AddUint32(&l.read, ^uint32(0)) // wrap to decrement by one
+}
+
+// Lock write locks, backing off until it can.
+func (l *Lock) Lock() {
+	var b backoff
+	for {
+		// A stale read turn with nobody waiting does not hold us up;
+		// the last waiting reader clears the turn, but may race with
+		// WUnlock setting it.
+		if !l.fair ||
+			primitive.LoadUint32(&l.readTurn) == 0 ||
+			primitive.LoadInt32(&l.rwaiting) == 0 {
+			if l.TryLock() {
+				return
+			}
+		}
+		b.wait()
+	}
+}
+
+// RLock read locks, backing off until it can.
+func (l *Lock) RLock() {
+	if l.TryRLock() {
+		return
+	}
+	if l.fair {
+		primitive.AddInt32(&l.rwaiting, 1)
+	}
+	var b backoff
+	for !l.TryRLock() {
+		b.wait()
+	}
+	if l.fair && primitive.AddInt32(&l.rwaiting, -1) == 0 {
+		primitive.StoreUint32(&l.readTurn, 0)
+	}
+}
+
+// Writing returns whether a writer holds the lock or is in the process of
+// locking or unlocking it. This is a racy snapshot, suitable only for
+// deciding whether an attempt is worthwhile.
+func (l *Lock) Writing() bool {
+	return primitive.LoadUint32(&l.write) != 0
+}
+
+// Pending returns whether a writer is waiting for the lock's current writer
+// to unlock. Like Writing, this is a racy snapshot.
+func (l *Lock) Pending() bool {
+	return primitive.LoadUint32(&l.write)&^highBit > 1
+}
+
+// maxSpins is the most pauses a backoff spins for before yielding instead.
+const maxSpins = 64
+
+// backoff spins for twice as long every wait, up to maxSpins pauses, after
+// which every wait yields the processor.
+type backoff uint32
+
+func (b *backoff) wait() {
+	if *b == 0 {
+		*b = 1
+	}
+	if *b > maxSpins {
+		primitive.Gosched()
+		return
+	}
+	for i := backoff(0); i < *b; i++ {
+		primitive.Pause()
+	}
+	*b <<= 1
+}
@@ -0,0 +1,109 @@
+//go:build dashsched
+// +build dashsched
+
+package rwlock
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/twmb/dash/sched"
+)
+
+// lockScenario returns a scenario with a thread per program racing on a lock.
+// Each program is a sequence of lock attempts, true for a write lock and false
+// for a read lock; every attempt that succeeds holds the lock across a yield
+// and then unlocks. The check verifies mutual exclusion and that the lock ends
+// up unlocked.
+func lockScenario(programs [][]bool) func() sched.Scenario {
+	return func() sched.Scenario {
+		var l Lock
+		var writers, readers int
+		var err error
+		check := func(what string) {
+			if err == nil && (writers > 1 || writers == 1 && readers > 0) {
+				err = fmt.Errorf("%s: %d writers and %d readers hold the lock", what, writers, readers)
+			}
+		}
+		write := func() {
+			if !l.TryLock() {
+				return
+			}
+			writers++
+			check("write lock")
+			sched.Yield()
+			writers--
+			l.WUnlock()
+		}
+		read := func() {
+			if !l.TryRLock() {
+				return
+			}
+			readers++
+			check("read lock")
+			sched.Yield()
+			readers--
+			l.RUnlock()
+		}
+
+		var threads []func()
+		for _, program := range programs {
+			program := program
+			threads = append(threads, func() {
+				for _, w := range program {
+					if w {
+						write()
+					} else {
+						read()
+					}
+				}
+			})
+		}
+		return sched.Scenario{
+			Threads: threads,
+			Check: func() error {
+				if err != nil {
+					return err
+				}
+				if l.write != 0 || l.read != 0 {
+					return fmt.Errorf("lock left in write state %x, read state %x", l.write, l.read)
+				}
+				return nil
+			},
+		}
+	}
+}
+
+// TestLockSchedules explores two writers and a reader racing on a lock.
+func TestLockSchedules(t *testing.T) {
+	err := sched.Explore(sched.Config{}, lockScenario([][]bool{{true}, {true}, {false}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FuzzLockSchedules decodes the first two bytes into up to three threads
+// running up to three lock attempts each, and the rest into a schedule.
+func FuzzLockSchedules(f *testing.F) {
+	f.Add([]byte{0x0a, 0x03, 0, 1, 2, 0, 1, 2})
+	f.Add([]byte{0x0b, 0xff, 1, 1, 0, 0, 2, 2, 1, 0})
+	f.Add([]byte{0x1b, 0x52, 2, 0, 0, 1, 1, 2, 0, 1, 2, 2, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 2 {
+			return
+		}
+		threads := 1 + int(data[0]%3)
+		attempts := 1 + int(data[0]>>2%3)
+		kinds := uint(data[1]) | uint(data[0]>>4)<<8
+		programs := make([][]bool, threads)
+		for i := range programs {
+			for j := 0; j < attempts; j++ {
+				programs[i] = append(programs[i], kinds&1 == 1)
+				kinds >>= 1
+			}
+		}
+		if err := sched.Decode(sched.Config{}, lockScenario(programs), data[2:]); err != nil {
+			t.Fatalf("programs %v: %v", programs, err)
+		}
+	})
+}
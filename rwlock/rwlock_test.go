@@ -0,0 +1,302 @@
+package rwlock
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These benchmarks demonstrate simple throughput differences of my lock vs.
+// sync.RWMutex, where my lock is marginally different, and then very contended
+// differences, where my lock fast track wlock returns.  In "very contended"
+// (i.e., anything with no number), benchmarks, we start 10 goroutines per proc.
+//
+// As it turns out, my lock is worst for almost any standard usage of a lock.
+// The main benefit comes from readers being _unable_ to get the lock if one
+// writer is in a pending state. Readers have no chance to exclude writers
+// during the pending transition. This is beneficial for a block.
+//
+// I have tried separating out the writer bits into a separate mutex. It is
+// much slower in _use_, even though benchmarks show better numbers for
+// directly grabbing the lock.
+
+func TestLock(t *testing.T) {
+	var l Lock
+	locked := l.TryLock()
+	if !locked {
+		t.Error("expected locked after TryLock")
+	}
+	go l.TryLock()
+	time.Sleep(time.Millisecond)
+	if atomic.LoadUint32(&l.write) != 2 {
+		t.Errorf("expected pendingWait after second TryLock")
+	}
+	if l.TryLock() {
+		t.Error("unexpected TryLock get on doubly locked lock")
+	}
+	l.WUnlock()
+	time.Sleep(time.Millisecond)
+	if atomic.LoadUint32(&l.write) != 1 {
+		t.Error("expected locked after unlock from pendingWait")
+	}
+
+}
+
+func TestWritingPending(t *testing.T) {
+	var l Lock
+	if l.Writing() || l.Pending() {
+		t.Error("unexpected writer on new lock")
+	}
+	l.TryLock()
+	if !l.Writing() || l.Pending() {
+		t.Error("expected writer without pending writer after TryLock")
+	}
+	go func() {
+		l.TryLock()
+		l.WUnlock()
+	}()
+	for !l.Pending() {
+		time.Sleep(time.Millisecond)
+	}
+	l.WUnlock()
+	for l.Writing() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBlocking checks that Lock and RLock wait for each other.
+func TestBlocking(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		l := new(Lock)
+		if fair {
+			l = NewFair()
+		}
+		l.RLock()
+		locked := make(chan struct{})
+		go func() {
+			l.Lock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+			t.Fatal("write locked while read locked")
+		case <-time.After(10 * time.Millisecond):
+		}
+		l.RUnlock()
+		<-locked
+
+		rlocked := make(chan struct{})
+		go func() {
+			l.RLock()
+			close(rlocked)
+		}()
+		select {
+		case <-rlocked:
+			t.Fatal("read locked while write locked")
+		case <-time.After(10 * time.Millisecond):
+		}
+		l.WUnlock()
+		<-rlocked
+		l.RUnlock()
+	}
+}
+
+// TestFair checks that a reader waiting on a fair lock gets a turn while
+// writers continually relock.
+func TestFair(t *testing.T) {
+	l := NewFair()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.Lock()
+				runtime.Gosched()
+				l.WUnlock()
+			}
+		}()
+	}
+	rlocked := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.RLock()
+			l.RUnlock()
+		}
+		close(rlocked)
+	}()
+	select {
+	case <-rlocked:
+	case <-time.After(time.Minute):
+		t.Error("reader starved by writers")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// wlock/wunlock
+
+func BenchmarkLockW1(b *testing.B) {
+	var l Lock
+	for i := 0; i < b.N; i++ {
+		if !l.TryLock() {
+			b.Fatal("unable to lock")
+		}
+		l.WUnlock()
+	}
+}
+
+func BenchmarkRWMutexW1(b *testing.B) {
+	var mtx sync.RWMutex
+	for i := 0; i < b.N; i++ {
+		mtx.Lock()
+		mtx.Unlock()
+	}
+}
+
+// rlock/runlock
+
+func BenchmarkLockR1(b *testing.B) {
+	var l Lock
+	for i := 0; i < b.N; i++ {
+		if !l.TryRLock() {
+			b.Fatal("unable to lock")
+		}
+		l.RUnlock()
+	}
+}
+
+func BenchmarkRWMutexR1(b *testing.B) {
+	var mtx sync.RWMutex
+	for i := 0; i < b.N; i++ {
+		mtx.RLock()
+		mtx.RUnlock()
+	}
+}
+
+// contended (two only) wlock/wunlock only two because my lock fast track
+// returns on more than two
+
+func BenchmarkLockW2(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	var l Lock
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !l.TryLock() {
+				panic(fmt.Sprintf("%b", l.write))
+			}
+			l.WUnlock()
+		}
+	})
+}
+
+func BenchmarkRWMutexW2(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	var mtx sync.RWMutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mtx.Lock()
+			mtx.Unlock()
+		}
+	})
+}
+
+// very contended rlock/runlock (10 goroutines per proc).
+
+func BenchmarkLockR(b *testing.B) {
+	b.SetParallelism(10) // 10 goroutines per proc
+	var l Lock
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !l.TryRLock() {
+				panic(fmt.Sprintf("%b", l.write))
+			}
+			l.RUnlock()
+		}
+	})
+}
+
+func BenchmarkRWMutexR(b *testing.B) {
+	b.SetParallelism(10)
+	var mtx sync.RWMutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mtx.RLock()
+			mtx.RUnlock()
+		}
+	})
+}
+
+// very contended wlock/wunlock
+
+func BenchmarkLockW(b *testing.B) {
+	b.SetParallelism(10)
+	var l Lock
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if l.TryLock() {
+				l.WUnlock()
+			}
+		}
+	})
+}
+
+func BenchmarkRWMutexW(b *testing.B) {
+	b.SetParallelism(10)
+	var mtx sync.RWMutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mtx.Lock()
+			mtx.Unlock()
+		}
+	})
+}
+
+// very contended competing wlock/wunlock and rlock/unlock
+
+func BenchmarkLockRW(b *testing.B) {
+	b.SetParallelism(10)
+	var l Lock
+	b.RunParallel(func(pb *testing.PB) {
+		full := true
+		for pb.Next() {
+			if full {
+				if l.TryLock() {
+					l.WUnlock()
+				}
+			} else {
+				if l.TryRLock() {
+					l.RUnlock()
+				}
+			}
+			full = !full
+		}
+	})
+}
+
+func BenchmarkRWMutexRW(b *testing.B) {
+	b.SetParallelism(10)
+	var mtx sync.RWMutex
+	b.RunParallel(func(pb *testing.PB) {
+		full := true
+		for pb.Next() {
+			if full {
+				mtx.Lock()
+				mtx.Unlock()
+			} else {
+				mtx.RLock()
+				mtx.RUnlock()
+			}
+			full = !full
+		}
+	})
+}
@@ -0,0 +1,472 @@
+// Package sched explores thread interleavings of small concurrent scenarios,
+// in the spirit of CHESS and loom.
+//
+// Bugs in lock-free code often only show up under rare interleavings that
+// stress tests never hit. When dash is built with the dashsched tag, the
+// atomic operations and compare-and-swap helpers in primitive yield to this
+// package before every operation. Explore runs a scenario's threads one at a
+// time, choosing at every yield which thread runs next, and repeats the
+// scenario under different choices: either every schedule within a
+// preemption bound, or a number of random schedules. If a thread panics, the
+// scenario's check fails, or the threads never finish, Explore returns the
+// failing schedule, which Replay can then rerun deterministically.
+//
+// A scenario must be deterministic apart from scheduling, and its threads
+// must not block on anything other than instrumented primitives (sync.Mutex,
+// channels, and so on are invisible to the scheduler). Spin loops must call
+// primitive.Pause or primitive.Gosched, which tell the scheduler to run a
+// different thread. Only a scenario's threads may use the instrumented
+// primitives while Explore is running, and Explore must not be called
+// concurrently.
+//
+// Without the dashsched tag, nothing yields, and Explore runs each thread to
+// completion in turn.
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Scenario is one run of the code under test. Threads run concurrently under
+// the scheduler, after which Check, if non-nil, validates the end state.
+type Scenario struct {
+	Threads []func()
+	Check   func() error
+}
+
+// Schedule is the order threads ran in: the thread chosen at the start and at
+// every yield.
+type Schedule []int
+
+// Failure is returned from Explore, Replay, and Decode when a schedule fails.
+type Failure struct {
+	Schedule Schedule
+	Err      error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("sched: schedule %v failed: %v", f.Schedule, f.Err)
+}
+
+// String returns the schedule run-length encoded, with long schedules cut to
+// their last steps.
+func (s Schedule) String() string {
+	const max = 64
+	var b strings.Builder
+	b.WriteByte('[')
+	if len(s) > max {
+		fmt.Fprintf(&b, "(%d steps) ... ", len(s))
+		s = s[len(s)-max:]
+	}
+	for i := 0; i < len(s); {
+		j := i + 1
+		for j < len(s) && s[j] == s[i] {
+			j++
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%d", s[i])
+		if j-i > 1 {
+			fmt.Fprintf(&b, "*%d", j-i)
+		}
+		i = j
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+var (
+	// ErrStepLimit is a Failure's Err if a schedule ran for more than
+	// Config.MaxSteps steps, which usually means the threads livelocked.
+	ErrStepLimit = errors.New("step limit exceeded")
+	// ErrBlocked is a Failure's Err if a thread blocked outside of the
+	// scheduler for longer than Config.Timeout.
+	ErrBlocked = errors.New("thread blocked outside of the scheduler")
+	// ErrNondeterministic is a Failure's Err if a scenario did not offer
+	// the same choices when rerun under the same schedule.
+	ErrNondeterministic = errors.New("scenario is not deterministic")
+)
+
+// Config configures Explore.
+type Config struct {
+	// Random, if positive, is the number of random schedules to explore,
+	// seeded with Seed. Otherwise, every schedule within the preemption
+	// bound is explored.
+	Random int
+	Seed   int64
+	// Preemptions bounds the number of times a schedule switches away
+	// from a thread that could have kept running. Switching away from a
+	// spinning thread is not a preemption. Zero means 2; negative means
+	// unbounded.
+	Preemptions int
+	// MaxSteps bounds the number of steps in one schedule. Zero means
+	// 10000.
+	MaxSteps int
+	// Timeout bounds how long one schedule can run, catching threads
+	// that block outside of the scheduler. Zero means ten seconds.
+	Timeout time.Duration
+}
+
+// execution is the state of one run of a scenario.
+type execution struct {
+	threads  []thread
+	cur      int
+	steps    int
+	maxSteps int
+	// choose returns the index of the option to run next.
+	choose      func(options []int) (int, error)
+	preemptions int
+	bound       int
+
+	schedule Schedule
+	aborted  bool
+	err      error
+	done     chan struct{}
+}
+
+type thread struct {
+	wake     chan struct{}
+	finished bool
+	// spinning is set when the thread spins, and cleared when any thread
+	// writes. Spinning threads are only run if every other thread is
+	// spinning, which keeps spinners from starving other threads forever.
+	spinning bool
+}
+
+// current is the running execution, if any.
+var current atomic.Value
+
+func load() *execution {
+	e, _ := current.Load().(*execution)
+	return e
+}
+
+// The kinds of scheduling points.
+const (
+	write = iota
+	read
+	spin
+)
+
+// Yield is a scheduling point before an operation that may write shared
+// memory: the scheduler may switch to a different thread before Yield
+// returns. The instrumented primitives call Yield or YieldRead before every
+// operation; scenarios can also call Yield to allow interleavings around
+// plain memory accesses.
+func Yield() {
+	if e := load(); e != nil {
+		e.yield(write)
+	}
+}
+
+// YieldRead is Yield before an operation that only reads shared memory.
+func YieldRead() {
+	if e := load(); e != nil {
+		e.yield(read)
+	}
+}
+
+// Spin is a scheduling point for a thread that cannot make progress until
+// another thread writes. The scheduler switches to another thread if there is
+// one, preferring threads that are not themselves spinning. Outside of
+// Explore, Spin calls runtime.Gosched.
+func Spin() {
+	if e := load(); e != nil {
+		e.yield(spin)
+		return
+	}
+	runtime.Gosched()
+}
+
+func (e *execution) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+	e.aborted = true
+}
+
+// pick chooses the next thread from options, recording the choice.
+func (e *execution) pick(options []int) int {
+	i, err := e.choose(options)
+	if err != nil {
+		e.fail(err)
+		i = 0
+	}
+	e.schedule = append(e.schedule, options[i])
+	return options[i]
+}
+
+// switchTo hands control from thread me to thread next, returning once me is
+// scheduled again.
+func (e *execution) switchTo(me, next int) {
+	e.cur = next
+	e.threads[next].wake <- struct{}{}
+	<-e.threads[me].wake
+	if e.aborted {
+		runtime.Goexit()
+	}
+}
+
+// others returns the unfinished threads other than me, skipping spinning
+// threads unless every other thread is spinning. Threads are ordered starting
+// after me, so that always taking the first option runs threads round robin.
+func (e *execution) others(me int, skipSpinning bool) []int {
+	var options []int
+	for n := 1; n < len(e.threads); n++ {
+		i := (me + n) % len(e.threads)
+		t := &e.threads[i]
+		if !t.finished && !(skipSpinning && t.spinning) {
+			options = append(options, i)
+		}
+	}
+	if len(options) == 0 && skipSpinning {
+		return e.others(me, false)
+	}
+	return options
+}
+
+func (e *execution) yield(kind int) {
+	if e.aborted {
+		runtime.Goexit()
+	}
+	me := e.cur
+	if e.steps++; e.steps > e.maxSteps {
+		e.fail(ErrStepLimit)
+		runtime.Goexit()
+	}
+
+	var options []int
+	switch {
+	case kind == spin:
+		e.threads[me].spinning = true
+		options = e.others(me, true)
+	case e.bound < 0 || e.preemptions < e.bound:
+		options = append([]int{me}, e.others(me, true)...)
+	default:
+		options = []int{me}
+	}
+	if len(options) == 0 {
+		// Spinning with nothing else to run; keep spinning until we
+		// hit the step limit.
+		options = append(options, me)
+	}
+	if next := e.pick(options); next != me {
+		if kind != spin {
+			e.preemptions++
+		}
+		e.switchTo(me, next)
+	}
+
+	// We are about to run our operation; if it writes, spinners may now
+	// be able to make progress.
+	if kind == write {
+		for i := range e.threads {
+			e.threads[i].spinning = false
+		}
+	}
+}
+
+// finish marks thread me as finished and runs the next thread, or signals that
+// the execution is done.
+func (e *execution) finish(me int) {
+	e.threads[me].finished = true
+	var options []int
+	for i := range e.threads {
+		if !e.threads[i].finished {
+			options = append(options, i)
+		}
+	}
+	if len(options) == 0 {
+		close(e.done)
+		return
+	}
+	next := e.pick(options)
+	e.cur = next
+	e.threads[next].wake <- struct{}{}
+}
+
+// run runs one execution of a scenario.
+func run(cfg Config, setup func() Scenario, choose func([]int) (int, error), bound int) (Schedule, error) {
+	s := setup()
+	e := &execution{
+		threads:  make([]thread, len(s.Threads)),
+		maxSteps: cfg.MaxSteps,
+		choose:   choose,
+		bound:    bound,
+		done:     make(chan struct{}),
+	}
+	if len(s.Threads) == 0 {
+		return nil, nil
+	}
+	for i := range e.threads {
+		e.threads[i].wake = make(chan struct{}, 1)
+	}
+
+	current.Store(e)
+	for i, fn := range s.Threads {
+		go func(i int, fn func()) {
+			<-e.threads[i].wake
+			defer func() {
+				if r := recover(); r != nil {
+					e.fail(fmt.Errorf("thread %d panicked: %v", i, r))
+				}
+				e.finish(i)
+			}()
+			if !e.aborted {
+				fn()
+			}
+		}(i, fn)
+	}
+	all := make([]int, len(s.Threads))
+	for i := range all {
+		all[i] = i
+	}
+	e.cur = e.pick(all)
+	e.threads[e.cur].wake <- struct{}{}
+
+	timer := time.NewTimer(cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case <-e.done:
+	case <-timer.C:
+		// We cannot stop the blocked thread, so we leave it, and the
+		// execution, running.
+		current.Store((*execution)(nil))
+		return append(Schedule(nil), e.schedule...), ErrBlocked
+	}
+	current.Store((*execution)(nil))
+
+	if e.err != nil {
+		return e.schedule, e.err
+	}
+	if s.Check != nil {
+		return e.schedule, s.Check()
+	}
+	return e.schedule, nil
+}
+
+func (cfg *Config) defaults() {
+	if cfg.Preemptions == 0 {
+		cfg.Preemptions = 2
+	}
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = 10000
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+}
+
+// choice is one choice point in a depth first exploration.
+type choice struct {
+	idx int
+	n   int
+}
+
+// Explore runs the scenario returned by setup, which is called once per run,
+// under many schedules, returning a *Failure for the first schedule that
+// fails, or nil if every explored schedule passed.
+func Explore(cfg Config, setup func() Scenario) error {
+	cfg.defaults()
+
+	if cfg.Random > 0 {
+		rng := rand.New(rand.NewSource(cfg.Seed))
+		choose := func(options []int) (int, error) {
+			return rng.Intn(len(options)), nil
+		}
+		for i := 0; i < cfg.Random; i++ {
+			if schedule, err := run(cfg, setup, choose, -1); err != nil {
+				return &Failure{schedule, err}
+			}
+		}
+		return nil
+	}
+
+	// Stateless depth first search: every run replays the choices in
+	// prefix, then takes the first option at every new choice point. After
+	// each run, we advance the deepest choice that has options left.
+	var prefix []choice
+	for {
+		pos := 0
+		choose := func(options []int) (int, error) {
+			if pos < len(prefix) {
+				c := prefix[pos]
+				pos++
+				if c.n != len(options) {
+					return 0, ErrNondeterministic
+				}
+				return c.idx, nil
+			}
+			prefix = append(prefix, choice{0, len(options)})
+			pos++
+			return 0, nil
+		}
+		if schedule, err := run(cfg, setup, choose, cfg.Preemptions); err != nil {
+			return &Failure{schedule, err}
+		}
+
+		for len(prefix) > 0 && prefix[len(prefix)-1].idx+1 == prefix[len(prefix)-1].n {
+			prefix = prefix[:len(prefix)-1]
+		}
+		if len(prefix) == 0 {
+			return nil
+		}
+		prefix[len(prefix)-1].idx++
+	}
+}
+
+// Replay runs the scenario returned by setup under schedule, returning a
+// *Failure if the schedule fails.
+func Replay(cfg Config, setup func() Scenario, schedule Schedule) error {
+	cfg.defaults()
+	pos := 0
+	choose := func(options []int) (int, error) {
+		if pos < len(schedule) {
+			want := schedule[pos]
+			pos++
+			for i, option := range options {
+				if option == want {
+					return i, nil
+				}
+			}
+		}
+		return 0, ErrNondeterministic
+	}
+	if ran, err := run(cfg, setup, choose, -1); err != nil {
+		return &Failure{ran, err}
+	}
+	return nil
+}
+
+// Decode runs the scenario returned by setup once, under the schedule decoded
+// from choices: each choice point consumes a byte b and takes option b%n of
+// its n options, and once choices runs out, threads run until they finish or
+// spin. Decode lets a fuzzer search for failing schedules:
+//
+//	f.Fuzz(func(t *testing.T, choices []byte) {
+//		if err := sched.Decode(sched.Config{}, setup, choices); err != nil {
+//			t.Fatal(err)
+//		}
+//	})
+func Decode(cfg Config, setup func() Scenario, choices []byte) error {
+	cfg.defaults()
+	choose := func(options []int) (int, error) {
+		if len(choices) == 0 {
+			return 0, nil
+		}
+		b := choices[0]
+		choices = choices[1:]
+		return int(b) % len(options), nil
+	}
+	if ran, err := run(cfg, setup, choose, -1); err != nil {
+		return &Failure{ran, err}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// racyIncr is a scenario of two threads non-atomically incrementing a
+// counter, which loses an update under some schedules.
+func racyIncr(runs *int) func() Scenario {
+	return func() Scenario {
+		*runs++
+		var x int
+		incr := func() {
+			v := x
+			Yield()
+			x = v + 1
+		}
+		return Scenario{
+			Threads: []func(){incr, incr},
+			Check: func() error {
+				if x != 2 {
+					return fmt.Errorf("x = %d, want 2", x)
+				}
+				return nil
+			},
+		}
+	}
+}
+
+func TestExploreFindsRace(t *testing.T) {
+	var runs int
+	err := Explore(Config{}, racyIncr(&runs))
+	var f *Failure
+	if !errors.As(err, &f) {
+		t.Fatalf("got %v, want a failure", err)
+	}
+	if runs < 2 {
+		t.Errorf("failed after %d runs; the first schedule runs threads in order and should pass", runs)
+	}
+
+	// The failing schedule replays to the same failure, while a serial
+	// schedule passes.
+	if err := Replay(Config{}, racyIncr(&runs), f.Schedule); err == nil {
+		t.Errorf("replay of %v passed", f.Schedule)
+	}
+	if err := Replay(Config{}, racyIncr(&runs), Schedule{0, 0, 1, 1}); err != nil {
+		t.Errorf("serial replay failed: %v", err)
+	}
+}
+
+func TestExploreRandom(t *testing.T) {
+	var runs int
+	if err := Explore(Config{Random: 100}, racyIncr(&runs)); err == nil {
+		t.Fatal("random exploration did not find the lost update")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var runs int
+	if err := Decode(Config{}, racyIncr(&runs), nil); err != nil {
+		t.Errorf("serial decode failed: %v", err)
+	}
+	// Start thread 0, then switch to thread 1 at thread 0's yield.
+	if err := Decode(Config{}, racyIncr(&runs), []byte{0, 1}); err == nil {
+		t.Error("interleaved decode passed")
+	}
+	// Out of range choices wrap.
+	if err := Decode(Config{}, racyIncr(&runs), []byte{2, 3}); err == nil {
+		t.Error("wrapped interleaved decode passed")
+	}
+}
+
+func TestExploreAll(t *testing.T) {
+	// With no preemption bound, every interleaving of the threads'
+	// appends must be explored.
+	orders := make(map[string]bool)
+	err := Explore(Config{Preemptions: -1}, func() Scenario {
+		var order []byte
+		thread := func(id byte) func() {
+			return func() {
+				Yield()
+				order = append(order, id)
+				Yield()
+				order = append(order, id)
+			}
+		}
+		return Scenario{
+			Threads: []func(){thread('a'), thread('b'), thread('c')},
+			Check: func() error {
+				orders[string(order)] = true
+				return nil
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every interleaving of aa, bb, and cc: 6!/(2!2!2!).
+	if len(orders) != 90 {
+		t.Errorf("saw %d orders, want 90", len(orders))
+	}
+}
+
+func TestSpin(t *testing.T) {
+	err := Explore(Config{}, func() Scenario {
+		var flag bool
+		return Scenario{
+			Threads: []func(){
+				func() {
+					for !flag {
+						Spin()
+					}
+				},
+				func() {
+					Yield()
+					flag = true
+				},
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Explore(Config{MaxSteps: 100}, func() Scenario {
+		return Scenario{Threads: []func(){func() {
+			for {
+				Spin()
+			}
+		}}}
+	})
+	var f *Failure
+	if !errors.As(err, &f) || f.Err != ErrStepLimit {
+		t.Fatalf("got %v, want step limit failure", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	err := Explore(Config{}, func() Scenario {
+		return Scenario{Threads: []func(){
+			func() { Yield() },
+			func() { panic("boom") },
+		}}
+	})
+	if err == nil {
+		t.Fatal("panic not reported")
+	}
+}
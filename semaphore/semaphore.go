@@ -0,0 +1,179 @@
+// Package semaphore provides a weighted counting semaphore.
+//
+// A Semaphore holds a fixed number of permits. Acquiring takes permits,
+// waiting while too few are available, and releasing returns them. When
+// permits are available, acquiring and releasing are a few atomic operations
+// on a permit counter.
+//
+// By default, waiters retry around a block.Block, and whichever waiter's
+// retry fits in the available permits wins. This lets small acquisitions
+// overtake a large one waiting for many permits. A Semaphore created with
+// NewFIFO instead grants permits to waiters in the order they started
+// waiting, so that large acquisitions are not starved, at the cost of a mutex
+// and channel per wait.
+package semaphore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/primitive"
+)
+
+// Semaphore is a weighted counting semaphore.
+type Semaphore struct {
+	_pad0   [primitive.FalseShare - 8]byte
+	permits int64
+	_pad1   [primitive.FalseShare - 8]byte
+	waiting int32
+	_pad2   [primitive.FalseShare - 4]byte
+
+	size int64
+	b    *block.Block
+
+	// For FIFO semaphores, mu guards waiters, the queue of *waiter in the
+	// order they started waiting.
+	fifo    bool
+	mu      sync.Mutex
+	waiters list.List
+}
+
+// waiter is a FIFO acquisition waiting for n permits. ready is closed once
+// the permits are granted.
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// New returns a semaphore with size permits.
+func New(size int64) *Semaphore {
+	return &Semaphore{
+		permits: size,
+		size:    size,
+		b:       block.New(),
+	}
+}
+
+// NewFIFO returns a semaphore with size permits that grants permits to
+// waiters in the order they started waiting.
+//
+// TryAcquire fails while anybody is waiting, rather than overtaking them.
+func NewFIFO(size int64) *Semaphore {
+	s := New(size)
+	s.fifo = true
+	return s
+}
+
+// take takes n permits if that many are available.
+func (s *Semaphore) take(n int64) bool {
+	permits := primitive.LoadInt64(&s.permits)
+	for permits >= n {
+		var swapped bool
+		if permits, swapped = primitive.CompareAndSwapInt64(&s.permits, permits, permits-n); swapped {
+			return true
+		}
+	}
+	return false
+}
+
+// TryAcquire acquires n permits without waiting, returning whether it did.
+func (s *Semaphore) TryAcquire(n int64) bool {
+	if s.fifo && primitive.LoadInt32(&s.waiting) > 0 {
+		return false
+	}
+	return s.take(n)
+}
+
+// Acquire acquires n permits, waiting until they are available or ctx is
+// done. If ctx is done first, Acquire returns ctx.Err() and acquires nothing.
+//
+// Acquiring more permits than the semaphore's size waits until ctx is done.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	if s.TryAcquire(n) {
+		return nil
+	}
+	if n > s.size {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if s.fifo {
+		return s.acquireFIFO(ctx, n)
+	}
+	return s.b.DoContext(ctx, func() bool { return s.take(n) })
+}
+
+func (s *Semaphore) acquireFIFO(ctx context.Context, n int64) error {
+	w := &waiter{n: n, ready: make(chan struct{})}
+	s.mu.Lock()
+	// We announce ourselves before granting: a concurrent Release either
+	// sees us waiting and grants, or released before our grant here.
+	primitive.AddInt32(&s.waiting, 1)
+	elem := s.waiters.PushBack(w)
+	s.grant()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready:
+		// We were granted our permits while giving up. Rather than
+		// releasing them, we pretend we did not notice ctx.
+		return nil
+	default:
+	}
+	front := s.waiters.Front() == elem
+	s.waiters.Remove(elem)
+	primitive.AddInt32(&s.waiting, -1)
+	// If we were first, we may have been holding up waiters behind us
+	// that now fit.
+	if front {
+		s.grant()
+	}
+	return ctx.Err()
+}
+
+// grant, called with mu held, grants permits to waiters in order until the
+// first waiter does not fit.
+func (s *Semaphore) grant() {
+	for {
+		elem := s.waiters.Front()
+		if elem == nil {
+			return
+		}
+		w := elem.Value.(*waiter)
+		if !s.take(w.n) {
+			return
+		}
+		s.waiters.Remove(elem)
+		primitive.AddInt32(&s.waiting, -1)
+		close(w.ready)
+	}
+}
+
+// Release releases n permits.
+func (s *Semaphore) Release(n int64) {
+	primitive.AddInt64(&s.permits, n)
+	if !s.fifo {
+		s.b.Signal()
+		return
+	}
+	if primitive.LoadInt32(&s.waiting) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.grant()
+	s.mu.Unlock()
+}
+
+// Available returns the number of permits currently available.
+func (s *Semaphore) Available() int64 {
+	return primitive.LoadInt64(&s.permits)
+}
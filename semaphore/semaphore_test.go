@@ -0,0 +1,130 @@
+package semaphore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTryAcquire(t *testing.T) {
+	for _, s := range []*Semaphore{New(3), NewFIFO(3)} {
+		if !s.TryAcquire(2) {
+			t.Fatal("unable to acquire 2 of 3 permits")
+		}
+		if s.TryAcquire(2) {
+			t.Fatal("acquired 2 permits with 1 available")
+		}
+		if !s.TryAcquire(1) {
+			t.Fatal("unable to acquire last permit")
+		}
+		s.Release(3)
+		if avail := s.Available(); avail != 3 {
+			t.Errorf("got %d available after releasing all, expected 3", avail)
+		}
+	}
+}
+
+func TestAcquireContext(t *testing.T) {
+	for _, s := range []*Semaphore{New(1), NewFIFO(1)} {
+		s.TryAcquire(1)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := s.Acquire(ctx, 1); err != context.DeadlineExceeded {
+			t.Errorf("got %v acquiring from empty semaphore, expected %v", err, context.DeadlineExceeded)
+		}
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := s.Acquire(ctx, 2); err != context.DeadlineExceeded {
+			t.Errorf("got %v acquiring more than size, expected %v", err, context.DeadlineExceeded)
+		}
+		cancel()
+
+		done := make(chan error)
+		go func() { done <- s.Acquire(context.Background(), 1) }()
+		time.Sleep(10 * time.Millisecond)
+		s.Release(1)
+		if err := <-done; err != nil {
+			t.Errorf("got %v acquiring after release, expected nil", err)
+		}
+		if avail := s.Available(); avail != 0 {
+			t.Errorf("got %d available, expected 0", avail)
+		}
+	}
+}
+
+// TestFIFO checks that a large waiter is not overtaken by a later small
+// waiter, and that giving up at the front lets those behind through.
+func TestFIFO(t *testing.T) {
+	s := NewFIFO(2)
+	s.TryAcquire(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	large := make(chan error)
+	go func() { large <- s.Acquire(ctx, 2) }()
+	for atomic.LoadInt32(&s.waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	small := make(chan error)
+	go func() { small <- s.Acquire(context.Background(), 1) }()
+	for atomic.LoadInt32(&s.waiting) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Release(1)
+	select {
+	case <-small:
+		t.Fatal("small waiter overtook large waiter")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if s.TryAcquire(1) {
+		t.Fatal("TryAcquire overtook waiters")
+	}
+
+	cancel()
+	if err := <-large; err != context.Canceled {
+		t.Errorf("got %v from canceled large waiter, expected %v", err, context.Canceled)
+	}
+	if err := <-small; err != nil {
+		t.Errorf("got %v from small waiter, expected nil", err)
+	}
+}
+
+// TestLimit checks that concurrent weighted acquisitions never hold more
+// permits than the semaphore has.
+func TestLimit(t *testing.T) {
+	for _, fifo := range []bool{false, true} {
+		const size = 5
+		s := New(size)
+		if fifo {
+			s = NewFIFO(size)
+		}
+		var held, over int64
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			n := int64(1 + i%3)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 2000; j++ {
+					if err := s.Acquire(context.Background(), n); err != nil {
+						t.Error(err)
+						return
+					}
+					if atomic.AddInt64(&held, n) > size {
+						atomic.StoreInt64(&over, 1)
+					}
+					atomic.AddInt64(&held, -n)
+					s.Release(n)
+				}
+			}()
+		}
+		wg.Wait()
+		if over != 0 {
+			t.Errorf("fifo %v: held more than %d permits", fifo, size)
+		}
+		if avail := s.Available(); avail != size {
+			t.Errorf("fifo %v: got %d available after all releases, expected %d", fifo, avail, size)
+		}
+	}
+}
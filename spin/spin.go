@@ -0,0 +1,95 @@
+// This transliterates the spin cutoff learning in Facebook's folly's
+// TurnSequencer, which is licensed with Apache License, Version 2.0.
+
+// Package spin provides a learned estimate of how long to spin before
+// parking.
+//
+// Spinning before parking avoids the cost of sleeping and waking when what
+// we wait for happens soon, but wastes CPU when it does not. A Cutoff
+// learns, from waits that measure how long they would have needed to spin,
+// how many spins are usually worth it:
+//
+//	spins, learn := cutoff.Budget(probe)
+//	var tries uint32
+//	for ; !done(); tries++ {
+//		if tries < spins {
+//			primitive.Pause()
+//			continue
+//		}
+//		park()
+//	}
+//	if learn {
+//		cutoff.Learn(tries)
+//	}
+//
+// Probing waits spin for up to MaxSpins, so waiters should only probe
+// occasionally, such as one wait in every 128.
+package spin
+
+import (
+	"github.com/twmb/dash/primitive"
+)
+
+const (
+	// MinSpins is the minimum spin count that we will update a cutoff to.
+	MinSpins = 4
+	// MaxSpins is the maximum spin count that we will update a cutoff to,
+	// and the count we use when probing for updating.
+	MaxSpins = 2000
+)
+
+// Cutoff is a learned number of spins to make before parking. The zero Cutoff
+// has learned nothing, and the first wait to use it learns.
+type Cutoff struct {
+	spins uint32
+}
+
+// Budget returns how many times a wait should spin before parking, and
+// whether the wait should Learn from how many tries it took. Waits learn if
+// probe is set or nothing has been learned yet, and spin for up to MaxSpins
+// to measure how long spinning would take.
+func (c *Cutoff) Budget(probe bool) (spins uint32, learn bool) {
+	spins = primitive.LoadUint32(&c.spins)
+	if probe || spins == 0 {
+		return MaxSpins, true
+	}
+	return spins, false
+}
+
+// Learn folds a wait that finished after tries spins into the cutoff. A wait
+// that spun MaxSpins times or more lowers the cutoff towards MinSpins, as
+// spinning did not help it.
+func (c *Cutoff) Learn(tries uint32) {
+	var update uint32
+	if tries >= MaxSpins {
+		// If we hit MaxSpins, then spinning is pointless, so the right
+		// cutoff is the minimum possible.
+		update = MinSpins
+	} else {
+		// To account for variations, we allow ourself to spin 2*N when
+		// we think that N is actually required in order to succeed.
+		update = MinSpins
+		dubTries := tries << 1
+		if dubTries > update {
+			update = dubTries
+		}
+		if MaxSpins < update {
+			update = MaxSpins
+		}
+	}
+	given := primitive.LoadUint32(&c.spins)
+	if given == 0 {
+		primitive.StoreUint32(&c.spins, update)
+		return
+	}
+	// Per Facebook, "Exponential moving average with alpha of 7/8"... k.
+	update = uint32(int(given) + (int(update)-int(given))>>3)
+	// Try once but keep moving if somebody else updated.
+	primitive.CompareAndSwapUint32(&c.spins, given, update)
+}
+
+// Spins returns the cutoff's current number of spins, or zero if it has not
+// learned anything.
+func (c *Cutoff) Spins() uint32 {
+	return primitive.LoadUint32(&c.spins)
+}
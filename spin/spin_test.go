@@ -0,0 +1,37 @@
+package spin
+
+import "testing"
+
+func TestBudget(t *testing.T) {
+	var c Cutoff
+	if spins, learn := c.Budget(false); spins != MaxSpins || !learn {
+		t.Errorf("got budget %d, learn %v before learning, expected %d, true", spins, learn, MaxSpins)
+	}
+	c.Learn(100)
+	if spins, learn := c.Budget(false); spins != 200 || learn {
+		t.Errorf("got budget %d, learn %v after learning, expected 200, false", spins, learn)
+	}
+	if spins, learn := c.Budget(true); spins != MaxSpins || !learn {
+		t.Errorf("got budget %d, learn %v probing, expected %d, true", spins, learn, MaxSpins)
+	}
+}
+
+func TestLearn(t *testing.T) {
+	for _, test := range []struct {
+		given, tries, exp uint32
+	}{
+		{0, 100, 200},                // first learn takes 2*tries
+		{0, 1, MinSpins},             // clamped up to MinSpins
+		{0, MaxSpins - 1, MaxSpins},  // clamped down to MaxSpins
+		{0, MaxSpins, MinSpins},      // spinning did not help
+		{200, 200, 200 + 200>>3},     // moving average towards 400
+		{200, 20, 200 - (200-40)>>3}, // moving average towards 40
+		{200, MaxSpins, 175},         // towards MinSpins, flooring -24.5
+	} {
+		c := Cutoff{spins: test.given}
+		c.Learn(test.tries)
+		if got := c.Spins(); got != test.exp {
+			t.Errorf("cutoff %d learning %d tries: got %d, expected %d", test.given, test.tries, got, test.exp)
+		}
+	}
+}
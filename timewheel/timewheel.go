@@ -0,0 +1,330 @@
+// Package timewheel provides a hierarchical timing wheel for scheduling large
+// numbers of timers.
+//
+// A timing wheel trades timer precision for cheap timer management. Timers
+// are bucketed into slots of a fixed tick granularity; adding, canceling, and
+// resetting a timer is O(1), and advancing the wheel by one tick only touches
+// the timers in one slot (plus, once every 64 ticks, a cascade of the timers
+// in one slot of a coarser level). This follows the Linux kernel's original
+// cascading timer wheel, which is based off Varghese and Lauck's "Hashed and
+// Hierarchical Timing Wheels".
+//
+// Expired timers are not run by the goroutine advancing the wheel. Instead,
+// they are handed off through an spmcdvq to a pool of worker goroutines, so
+// that slow timer functions do not delay advancing the wheel. If the workers
+// fall behind and the handoff queue fills, advancing blocks until workers
+// catch up.
+//
+// A Wheel either follows the real clock, advancing itself every tick, or, if
+// created with NewManual, only advances when Advance is called. The manual
+// mode allows tests to advance time deterministically.
+package timewheel
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/queue/spmc/spmcdvq"
+)
+
+const (
+	// slotBits is the log2 of the number of slots per level.
+	slotBits = 6
+	numSlots = 1 << slotBits
+	slotMask = numSlots - 1
+	// numLevels is the number of levels in our wheel. Timers further out
+	// than maxTicks are parked in the last level and re-cascaded until
+	// they are in range.
+	numLevels = 5
+	maxTicks  = 1<<(slotBits*numLevels) - 1
+
+	// handoffSize is the size of the queue used to pass expired timers to
+	// workers.
+	handoffSize = 1024
+)
+
+// Timer is a function scheduled to run on a Wheel.
+type Timer struct {
+	// next and prev link the timer into its slot; both are nil if the
+	// timer is not scheduled.
+	next *Timer
+	prev *Timer
+	// when is the tick the timer expires at.
+	when uint64
+	f    func()
+}
+
+func (t *Timer) unlink() {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.next = nil
+	t.prev = nil
+}
+
+// slot is a sentinel for a circular list of timers.
+type slot struct {
+	head Timer
+}
+
+func (s *slot) init() {
+	s.head.next = &s.head
+	s.head.prev = &s.head
+}
+
+func (s *slot) push(t *Timer) {
+	t.prev = s.head.prev
+	t.next = &s.head
+	s.head.prev.next = t
+	s.head.prev = t
+}
+
+// take removes and returns all timers in the slot as a nil terminated list
+// linked through next.
+func (s *slot) take() *Timer {
+	if s.head.next == &s.head {
+		return nil
+	}
+	first := s.head.next
+	s.head.prev.next = nil
+	s.init()
+	return first
+}
+
+// Wheel is a hierarchical timing wheel.
+type Wheel struct {
+	tick time.Duration
+
+	// mu protects now, the levels, and the links of all timers.
+	mu     sync.Mutex
+	now    uint64
+	levels [numLevels][numSlots]slot
+
+	// advMu serializes advancing, as the advancer is the single producer
+	// into expired.
+	advMu   sync.Mutex
+	fire    []*Timer
+	expired *spmcdvq.Queue
+	enqB    *block.Block
+	deqB    *block.Block
+
+	nworker int
+	workers sync.WaitGroup
+	// quit and done are only non-nil for real clock wheels.
+	quit chan struct{}
+	done chan struct{}
+}
+
+// New returns a Wheel that advances with the real clock every tick, running
+// expired timers on workers goroutines.
+func New(tick time.Duration, workers int) *Wheel {
+	w := newWheel(tick, workers)
+	w.quit = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run()
+	return w
+}
+
+// NewManual returns a Wheel that only advances when Advance is called,
+// running expired timers on workers goroutines.
+func NewManual(tick time.Duration, workers int) *Wheel {
+	return newWheel(tick, workers)
+}
+
+func newWheel(tick time.Duration, workers int) *Wheel {
+	if tick <= 0 {
+		panic("timewheel: non-positive tick")
+	}
+	if workers < 1 {
+		panic("timewheel: workers must be at least one")
+	}
+	w := &Wheel{
+		tick:    tick,
+		expired: spmcdvq.New(handoffSize),
+		enqB:    block.New(),
+		deqB:    block.New(),
+		nworker: workers,
+	}
+	for l := range w.levels {
+		for s := range w.levels[l] {
+			w.levels[l][s].init()
+		}
+	}
+	w.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+	return w
+}
+
+// run advances the wheel with the real clock until Stop.
+func (w *Wheel) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	start := time.Now()
+	var ticked uint64
+	for {
+		select {
+		case <-w.quit:
+			return
+		case now := <-ticker.C:
+			// Tickers drop ticks if we fall behind; we advance by
+			// however many ticks have actually elapsed.
+			target := uint64(now.Sub(start) / w.tick)
+			w.advance(target - ticked)
+			ticked = target
+		}
+	}
+}
+
+// Stop stops the wheel and waits for all workers to finish running any
+// already expired timers. Timers that have not expired are never run. The
+// wheel must not be used after Stop.
+func (w *Wheel) Stop() {
+	if w.quit != nil {
+		close(w.quit)
+		<-w.done
+	}
+	w.advMu.Lock()
+	for i := 0; i < w.nworker; i++ {
+		w.handoff(nil) // a nil timer tells a worker to quit
+	}
+	w.advMu.Unlock()
+	w.workers.Wait()
+}
+
+// ticks converts d into a count of ticks, rounding up. Timers always expire
+// at least one tick in the future.
+func (w *Wheel) ticks(d time.Duration) uint64 {
+	if d <= w.tick {
+		return 1
+	}
+	return uint64((d + w.tick - 1) / w.tick)
+}
+
+// Add schedules f to run on a worker after at least d.
+func (w *Wheel) Add(d time.Duration, f func()) *Timer {
+	t := &Timer{f: f}
+	w.mu.Lock()
+	t.when = w.now + w.ticks(d)
+	w.add(t)
+	w.mu.Unlock()
+	return t
+}
+
+// Cancel stops t from running, returning whether t was scheduled. If t has
+// already expired, Cancel returns false; t may be running or about to run.
+func (w *Wheel) Cancel(t *Timer) bool {
+	w.mu.Lock()
+	scheduled := t.next != nil
+	if scheduled {
+		t.unlink()
+	}
+	w.mu.Unlock()
+	return scheduled
+}
+
+// Reset reschedules t to run after at least d, returning whether t was
+// scheduled before the reset. As with Cancel, if t has already expired, it
+// may be running or about to run, and will run again after d.
+func (w *Wheel) Reset(t *Timer, d time.Duration) bool {
+	w.mu.Lock()
+	scheduled := t.next != nil
+	if scheduled {
+		t.unlink()
+	}
+	t.when = w.now + w.ticks(d)
+	w.add(t)
+	w.mu.Unlock()
+	return scheduled
+}
+
+// Advance advances a manual wheel by d, rounded down to the tick, handing off
+// every timer that expires to the workers. Advance must only be used on a
+// wheel created with NewManual.
+func (w *Wheel) Advance(d time.Duration) {
+	if w.quit != nil {
+		panic("timewheel: Advance on a real clock wheel")
+	}
+	w.advance(uint64(d / w.tick))
+}
+
+// add places t into the slot for t.when; mu must be held.
+func (w *Wheel) add(t *Timer) {
+	when := t.when
+	delta := when - w.now
+	if delta > maxTicks {
+		// Park this timer at the furthest slot; it will be
+		// re-cascaded until it is in range.
+		when = w.now + maxTicks
+		delta = maxTicks
+	}
+	level := uint(0)
+	for delta >= 1<<(slotBits*(level+1)) {
+		level++
+	}
+	w.levels[level][(when>>(slotBits*level))&slotMask].push(t)
+}
+
+// advance moves the wheel forward n ticks.
+func (w *Wheel) advance(n uint64) {
+	w.advMu.Lock()
+	defer w.advMu.Unlock()
+	for ; n > 0; n-- {
+		w.mu.Lock()
+		w.now++
+		now := w.now
+		// If a level wrapped, cascade the next level's current slot
+		// into the levels below it.
+		for l := uint(1); l < numLevels; l++ {
+			if now&(1<<(slotBits*l)-1) != 0 {
+				break
+			}
+			for t := w.levels[l][(now>>(slotBits*l))&slotMask].take(); t != nil; {
+				next := t.next
+				w.add(t)
+				t = next
+			}
+		}
+		for t := w.levels[0][now&slotMask].take(); t != nil; {
+			next := t.next
+			t.next = nil
+			w.fire = append(w.fire, t)
+			t = next
+		}
+		w.mu.Unlock()
+
+		for i, t := range w.fire {
+			w.handoff(t)
+			w.fire[i] = nil
+		}
+		w.fire = w.fire[:0]
+	}
+}
+
+// handoff passes an expired timer to the workers, blocking if the workers
+// have fallen behind.
+func (w *Wheel) handoff(t *Timer) {
+	ptr := unsafe.Pointer(t)
+	w.enqB.Do(func() bool { return w.expired.TryEnqueue(ptr) })
+	w.deqB.Signal()
+}
+
+// work runs expired timers until receiving a nil timer.
+func (w *Wheel) work() {
+	defer w.workers.Done()
+	for {
+		var ptr unsafe.Pointer
+		w.deqB.Do(func() (dequeued bool) {
+			ptr, dequeued = w.expired.TryDequeue()
+			return
+		})
+		w.enqB.Signal()
+		if ptr == nil {
+			return
+		}
+		(*Timer)(ptr).f()
+	}
+}
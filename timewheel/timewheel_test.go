@@ -0,0 +1,138 @@
+package timewheel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// firer returns a timer function that sends id on ch.
+func firer(ch chan int, id int) func() {
+	return func() { ch <- id }
+}
+
+func expectFire(t *testing.T, ch chan int, id int) {
+	select {
+	case got := <-ch:
+		if got != id {
+			t.Fatalf("got timer %d firing, expected %d", got, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timer %d did not fire", id)
+	}
+}
+
+func expectNone(t *testing.T, ch chan int) {
+	select {
+	case got := <-ch:
+		t.Fatalf("unexpected timer %d firing", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestManualAdvance(t *testing.T) {
+	w := NewManual(time.Millisecond, 2)
+	defer w.Stop()
+	ch := make(chan int, 10)
+
+	// 5000 ticks cascades through two levels.
+	for _, tt := range []struct {
+		id int
+		d  time.Duration
+	}{
+		{0, 0},
+		{1, 3 * time.Millisecond},
+		{2, 64 * time.Millisecond},
+		{3, 5000 * time.Millisecond},
+	} {
+		w.Add(tt.d, firer(ch, tt.id))
+	}
+
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 0)
+	w.Advance(time.Millisecond)
+	expectNone(t, ch)
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 1)
+	w.Advance(60 * time.Millisecond)
+	expectNone(t, ch)
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 2)
+	w.Advance(4935 * time.Millisecond)
+	expectNone(t, ch)
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 3)
+}
+
+func TestParked(t *testing.T) {
+	w := NewManual(time.Millisecond, 1)
+	defer w.Stop()
+
+	// Advancing past the range of the wheel takes too long to test, so
+	// we only check that out of range timers are parked in the furthest
+	// slot.
+	w.Advance(3 * time.Millisecond)
+	parked := w.Add((maxTicks+100)*time.Millisecond, func() { t.Error("parked timer fired") })
+	slot := &w.levels[numLevels-1][((w.now+maxTicks)>>(slotBits*(numLevels-1)))&slotMask]
+	if slot.head.next != parked {
+		t.Fatal("expected out of range timer parked in the furthest slot")
+	}
+	if !w.Cancel(parked) {
+		t.Error("expected parked timer to still be scheduled")
+	}
+}
+
+func TestCancelReset(t *testing.T) {
+	w := NewManual(time.Millisecond, 1)
+	defer w.Stop()
+	ch := make(chan int, 10)
+
+	canceled := w.Add(100*time.Millisecond, firer(ch, 0))
+	reset := w.Add(100*time.Millisecond, firer(ch, 1))
+	if !w.Cancel(canceled) {
+		t.Error("expected Cancel of scheduled timer to return true")
+	}
+	if w.Cancel(canceled) {
+		t.Error("expected Cancel of canceled timer to return false")
+	}
+	if !w.Reset(reset, 200*time.Millisecond) {
+		t.Error("expected Reset of scheduled timer to return true")
+	}
+
+	w.Advance(199 * time.Millisecond)
+	expectNone(t, ch)
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 1)
+	if w.Cancel(reset) {
+		t.Error("expected Cancel of fired timer to return false")
+	}
+	if w.Reset(reset, time.Millisecond) {
+		t.Error("expected Reset of fired timer to return false")
+	}
+	w.Advance(time.Millisecond)
+	expectFire(t, ch, 1)
+}
+
+func TestManyTimers(t *testing.T) {
+	// More timers than our handoff queue in one tick forces advancing to
+	// block on the workers.
+	w := NewManual(time.Millisecond, 4)
+	const n = 10 * handoffSize
+	var fired int64
+	for i := 0; i < n; i++ {
+		w.Add(time.Duration(i%3)*time.Millisecond, func() { atomic.AddInt64(&fired, 1) })
+	}
+	w.Advance(3 * time.Millisecond)
+	w.Stop()
+	if fired != n {
+		t.Errorf("got %d fired timers, expected %d", fired, n)
+	}
+}
+
+func TestRealClock(t *testing.T) {
+	w := New(time.Millisecond, 1)
+	defer w.Stop()
+	ch := make(chan int, 1)
+	w.Add(5*time.Millisecond, firer(ch, 0))
+	expectFire(t, ch, 0)
+}
@@ -0,0 +1,174 @@
+// Package wait provides interchangeable strategies for waiting around code
+// that may fail.
+//
+// A Strategy retries an operation, such as a queue's TryEnqueue, until it
+// succeeds, choosing what to do between failed attempts. Strategies trade
+// latency for CPU: Spin never gives up its processor and reacts fastest, while
+// Futex parks waiters and burns nothing while they sleep. In between, Yield
+// gives other goroutines a turn, Sleep backs off exponentially,
+// *block.Block spins briefly before parking, and *eventcount.EventCount parks
+// without spinning.
+//
+// Code that makes an operation able to succeed calls Signal, or SignalOne if
+// it made room for only one waiter to succeed. Strategies that do not park
+// ignore signals.
+//
+// Because every strategy shares one interface, wrappers that take a Strategy
+// at construction can be tuned per deployment without changing the code that
+// uses them.
+package wait
+
+import (
+	"math"
+	"time"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/eventcount"
+	"github.com/twmb/dash/experimental/futex"
+	"github.com/twmb/dash/primitive"
+)
+
+// Strategy waits around code that may fail.
+type Strategy interface {
+	// Do calls try until it returns true, waiting between attempts that
+	// fail.
+	Do(try func() bool)
+	// Signal, to be called after every operation that can make a try
+	// succeed, wakes all waiters.
+	Signal()
+	// SignalOne, to be called after an operation that can make one try
+	// succeed, wakes at least one waiter.
+	SignalOne()
+}
+
+var (
+	_ Strategy = Spin{}
+	_ Strategy = Yield{}
+	_ Strategy = Sleep{}
+	_ Strategy = (*Futex)(nil)
+	_ Strategy = (*block.Block)(nil)
+	_ Strategy = (*eventcount.EventCount)(nil)
+)
+
+// Spin busy-spins between attempts, hinting to the processor that it is
+// spinning. Spin has the lowest latency, but waiters never give up their
+// processor, so Spin should only be used when every waiter can have a
+// processor to itself. Otherwise, waiters can spin away the time a preempted
+// goroutine needs to finish the operation they are waiting on.
+type Spin struct{}
+
+// Do implements Strategy.
+func (Spin) Do(try func() bool) {
+	for !try() {
+		primitive.Pause()
+	}
+}
+
+// Signal is a no-op.
+func (Spin) Signal() {}
+
+// SignalOne is a no-op.
+func (Spin) SignalOne() {}
+
+// Yield yields the processor to other goroutines between attempts. Waiters
+// stay runnable, so Yield still uses CPU when nothing else is runnable.
+type Yield struct{}
+
+// Do implements Strategy.
+func (Yield) Do(try func() bool) {
+	for !try() {
+		primitive.Gosched()
+	}
+}
+
+// Signal is a no-op.
+func (Yield) Signal() {}
+
+// SignalOne is a no-op.
+func (Yield) SignalOne() {}
+
+// Sleep sleeps between attempts, starting at Min and doubling each failed
+// attempt up to Max. Min must be positive and no more than Max.
+//
+// Sleep uses little CPU, but an operation can succeed up to Max before a
+// waiter notices.
+type Sleep struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Do implements Strategy.
+func (s Sleep) Do(try func() bool) {
+	d := s.Min
+	for !try() {
+		time.Sleep(d)
+		if d *= 2; d > s.Max {
+			d = s.Max
+		}
+	}
+}
+
+// Signal is a no-op.
+func (Sleep) Signal() {}
+
+// SignalOne is a no-op.
+func (Sleep) SignalOne() {}
+
+// allWaiters is the futex wait mask every Futex waiter uses.
+const allWaiters = ^uintptr(0)
+
+// Futex parks waiters on a futex until signaled. Unlike *block.Block, waiters
+// do not spin before parking, and signaling only takes the futex's lock when
+// somebody may be parked.
+//
+// This uses the emulated futex from experimental/futex.
+type Futex struct {
+	_pad0   [primitive.FalseShare - 4]byte
+	waiters int32
+	_pad1   [primitive.FalseShare - 4]byte
+	f       *futex.Futex
+}
+
+// NewFutex returns a new Futex.
+func NewFutex() *Futex {
+	return &Futex{f: futex.New()}
+}
+
+// Do implements Strategy.
+func (f *Futex) Do(try func() bool) {
+	if try() {
+		return
+	}
+	// We announce ourselves before loading the state: a signal either
+	// sees us and wakes us, or bumped the state before our load, in which
+	// case our next try sees what it signaled for.
+	primitive.AddInt32(&f.waiters, 1)
+	for {
+		state := primitive.LoadUintptr(&f.f.State)
+		if try() {
+			break
+		}
+		f.f.Wait(state, allWaiters)
+	}
+	primitive.AddInt32(&f.waiters, -1)
+}
+
+// Signal implements Strategy.
+func (f *Futex) Signal() {
+	f.wake(math.MaxUint32)
+}
+
+// SignalOne implements Strategy.
+func (f *Futex) SignalOne() {
+	f.wake(1)
+}
+
+// wake bumps the futex state, so that waiters about to park do not, and then
+// wakes up to n parked waiters.
+func (f *Futex) wake(n uint32) {
+	primitive.AddUintptr(&f.f.State, 1)
+	if primitive.LoadInt32(&f.waiters) == 0 {
+		return
+	}
+	f.f.Wake(n, allWaiters)
+}
@@ -0,0 +1,167 @@
+package wait
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/twmb/dash/block"
+	"github.com/twmb/dash/eventcount"
+	"github.com/twmb/dash/queue/mpmc/mpmcdvq"
+)
+
+var strategies = []struct {
+	name string
+	new  func() Strategy
+}{
+	{"Spin", func() Strategy { return Spin{} }},
+	{"Yield", func() Strategy { return Yield{} }},
+	{"Sleep", func() Strategy { return Sleep{Min: time.Microsecond, Max: time.Millisecond} }},
+	{"Futex", func() Strategy { return NewFutex() }},
+	{"Block", func() Strategy { return block.New() }},
+	{"EventCount", func() Strategy { return eventcount.New() }},
+}
+
+// TestQueue passes values through a small queue, waiting on full and empty
+// with every strategy.
+func TestQueue(t *testing.T) {
+	for _, s := range strategies {
+		for _, one := range []bool{false, true} {
+			name := s.name
+			if one {
+				name += "/One"
+			}
+			t.Run(name, func(t *testing.T) { testQueue(t, s.new(), s.new(), one) })
+		}
+	}
+}
+
+func testQueue(t *testing.T, notFull, notEmpty Strategy, one bool) {
+	const producers, consumers, per = 4, 4, 5000
+	if _, spin := notFull.(Spin); spin && runtime.GOMAXPROCS(0) < producers+consumers {
+		t.Skip("too few processors for every spinning waiter")
+	}
+	q := mpmcdvq.New(4)
+	signal := func(s Strategy) {
+		if one {
+			s.SignalOne()
+		} else {
+			s.Signal()
+		}
+	}
+
+	var wg sync.WaitGroup
+	var sum int64
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= per; j++ {
+				j := j
+				v := unsafe.Pointer(&j)
+				notFull.Do(func() bool { return q.TryEnqueue(v) })
+				signal(notEmpty)
+			}
+		}()
+	}
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < producers*per/consumers; j++ {
+				var v unsafe.Pointer
+				notEmpty.Do(func() (dequeued bool) {
+					v, dequeued = q.TryDequeue()
+					return
+				})
+				atomic.AddInt64(&sum, int64(*(*int)(v)))
+				signal(notFull)
+			}
+		}()
+	}
+	wg.Wait()
+	if want := int64(producers * per * (per + 1) / 2); sum != want {
+		t.Errorf("got sum %d, expected %d", sum, want)
+	}
+}
+
+// TestFutexParks checks that a Futex waiter parks until signaled, and that
+// signaling without waiters does not touch the futex.
+func TestFutexParks(t *testing.T) {
+	f := NewFutex()
+	f.Signal()
+	f.SignalOne()
+
+	var ready int32
+	tries := make(chan struct{}, 16)
+	done := make(chan struct{})
+	go func() {
+		f.Do(func() bool {
+			tries <- struct{}{}
+			return atomic.LoadInt32(&ready) == 1
+		})
+		close(done)
+	}()
+	<-tries
+	<-tries
+	select {
+	case <-tries:
+		t.Fatal("Futex waiter retried without a signal")
+	case <-time.After(20 * time.Millisecond):
+	}
+	atomic.StoreInt32(&ready, 1)
+	f.SignalOne()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("Futex waiter did not wake on signal")
+	}
+	if waiters := atomic.LoadInt32(&f.waiters); waiters != 0 {
+		t.Errorf("got %d waiters after Do, expected 0", waiters)
+	}
+}
+
+// TestFutexSignalOneTwoFutexes checks that SignalOne wakes the waiter parked
+// on its own Futex, not one parked earlier on another Futex.
+func TestFutexSignalOneTwoFutexes(t *testing.T) {
+	a, b := NewFutex(), NewFutex()
+	park := func(f *Futex, ready *int32) chan struct{} {
+		tries, done := make(chan struct{}, 16), make(chan struct{})
+		go func() {
+			f.Do(func() bool {
+				tries <- struct{}{}
+				return atomic.LoadInt32(ready) == 1
+			})
+			close(done)
+		}()
+		// Do tries before announcing itself and once more before
+		// parking.
+		<-tries
+		<-tries
+		time.Sleep(10 * time.Millisecond)
+		return done
+	}
+	var readyA, readyB int32
+	doneB := park(b, &readyB)
+	doneA := park(a, &readyA)
+
+	for _, w := range []struct {
+		f     *Futex
+		ready *int32
+		done  chan struct{}
+	}{
+		{a, &readyA, doneA},
+		{b, &readyB, doneB},
+	} {
+		atomic.StoreInt32(w.ready, 1)
+		w.f.SignalOne()
+		select {
+		case <-w.done:
+		case <-time.After(time.Second):
+			t.Fatal("SignalOne did not wake the waiter on its own Futex")
+		}
+	}
+}